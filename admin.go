@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/davidrjonas/epplb/metrics"
+	"github.com/davidrjonas/epplb/pool"
+)
+
+// AdminServer serves the proxy's stats over HTTP: expvar JSON at /debug/vars,
+// the Prometheus text format at /metrics and the health of each proxy's
+// upstream pools at /health.
+type AdminServer struct {
+	server  *http.Server
+	proxies []*Proxy
+}
+
+// UpstreamHealth is the state of one pool of upstream sessions.
+type UpstreamHealth struct {
+	Healthy   bool   `json:"healthy"`
+	Open      int    `json:"open"`
+	Idle      int    `json:"idle"`
+	Waiting   int    `json:"waiting"`
+	Checks    uint64 `json:"checks"`
+	Failures  uint64 `json:"failures"`
+	LastCheck string `json:"last_check,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ProxyHealth is the state of a proxy's shared pool, of the pools of its
+// registry accounts, keyed by downstream clID, and of its endpoints.
+type ProxyHealth struct {
+	Healthy   bool                      `json:"healthy"`
+	Upstream  *UpstreamHealth           `json:"upstream,omitempty"`
+	Accounts  map[string]UpstreamHealth `json:"accounts,omitempty"`
+	Endpoints []EndpointHealth          `json:"endpoints,omitempty"`
+}
+
+func upstreamHealth(s pool.Stats) UpstreamHealth {
+	h := UpstreamHealth{
+		Healthy:   s.LastError == "",
+		Open:      s.Open,
+		Idle:      s.Idle,
+		Waiting:   s.Waiting,
+		Checks:    s.Checks,
+		Failures:  s.Failures,
+		LastError: s.LastError,
+	}
+
+	if !s.LastCheck.IsZero() {
+		h.LastCheck = s.LastCheck.Format(time.RFC3339)
+	}
+
+	return h
+}
+
+func NewAdminServer(addr string, proxies []*Proxy) *AdminServer {
+	a := &AdminServer{proxies: proxies}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/health", a.serveHealth)
+
+	a.server = &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	return a
+}
+
+// serveHealth answers 200 when every proxy is healthy and 503 otherwise, so
+// it can be used as a load balancer probe.
+func (a *AdminServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	out := make(map[string]ProxyHealth, len(a.proxies))
+
+	for _, p := range a.proxies {
+		h := p.Health()
+		if !h.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		out[p.Name] = h
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+func (a *AdminServer) Start() error {
+	listener, err := net.Listen("tcp", a.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin server error", "err", err)
+		}
+	}()
+
+	slog.Info("admin server started", "listen", a.server.Addr)
+
+	return nil
+}
+
+func (a *AdminServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a.server.Shutdown(ctx)
+}
@@ -0,0 +1,66 @@
+// Package audit keeps a record of every command sent to a registry and the
+// response that came back, one JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record is one command and its response. Request and Response are the
+// frames as sent and received with their passwords redacted.
+type Record struct {
+	Sent     time.Time `json:"sent"`
+	Received time.Time `json:"received"`
+
+	Session    string `json:"session"`
+	Proxy      string `json:"proxy"`
+	Downstream string `json:"downstream"`
+	ClID       string `json:"clid,omitempty"`
+	Upstream   string `json:"upstream"`
+
+	Command string   `json:"command"`
+	Objects []string `json:"objects,omitempty"`
+	ClTRID  string   `json:"cltrid,omitempty"`
+	SvTRID  string   `json:"svtrid,omitempty"`
+	Code    int      `json:"code"`
+	Error   string   `json:"error,omitempty"`
+
+	Request  string `json:"request"`
+	Response string `json:"response,omitempty"`
+}
+
+// Log writes records to a file or syslog. It is safe for concurrent use.
+type Log struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// New returns a Log writing to w, which is closed with the Log.
+func New(w io.WriteCloser) *Log {
+	return &Log{w: w}
+}
+
+// Write writes r as a single line.
+func (l *Log) Write(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(append(b, '\n'))
+
+	return err
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Close()
+}
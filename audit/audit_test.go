@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogWritesOneLinePerRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	f, err := OpenFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+
+	l := New(f)
+
+	sent := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	l.Write(Record{Sent: sent, Command: "check", Objects: []string{"a.com", "b.com"}, Code: 1000})
+	l.Write(Record{Sent: sent, Command: "info", Error: "broken pipe"})
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %q", len(lines), b)
+	}
+
+	var r Record
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatalf("Unmarshal failed with %v", err)
+	}
+
+	if !r.Sent.Equal(sent) || r.Command != "check" || r.Code != 1000 || len(r.Objects) != 2 {
+		t.Errorf("Unexpected record %+v", r)
+	}
+
+	if !strings.Contains(lines[1], `"error":"broken pipe"`) {
+		t.Error("Expected the error in", lines[1])
+	}
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	f, err := OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+
+	for _, s := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed with %v", err)
+		}
+	}
+
+	f.Close()
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+
+	for name, content := range expected {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Errorf("Expected %s; %v", name, err)
+			continue
+		}
+
+		if string(b) != content {
+			t.Errorf("Expected %q in %s, got %q", content, name, b)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups")
+	}
+}
+
+func TestRotatingFileKeepsOneBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	f, err := OpenFile(path, 10, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	f.Close()
+
+	if b, err := os.ReadFile(path + ".1"); err != nil || string(b) != "first\n" {
+		t.Errorf("Expected the first record in a backup, got %q; %v", b, err)
+	}
+}
+
+func TestRotatingFileSurvivesFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// A directory with something in it can't be renamed over or removed.
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+
+	for _, s := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed with %v", err)
+		}
+	}
+
+	f.Close()
+
+	if b, _ := os.ReadFile(path); string(b) != "first\nsecond\nthird\n" {
+		t.Errorf("Expected every record in the file, got %q", b)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	os.WriteFile(path, []byte("old\n"), 0600)
+
+	f, err := OpenFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+
+	f.Write([]byte("new\n"))
+	f.Close()
+
+	if b, _ := os.ReadFile(path); string(b) != "old\nnew\n" {
+		t.Errorf("Expected the file to be appended to, got %q", b)
+	}
+}
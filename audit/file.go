@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// RotatingFile is a file that is renamed to path.1 once it grows past
+// maxSize, shifting older backups up and removing any past maxBackups. It is
+// not safe for concurrent use on its own; Log serialises its writes.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+// OpenFile opens, or creates, path for appending. A maxSize of 0 never
+// rotates. Rotating always keeps at least one backup, so records are never
+// thrown away.
+func OpenFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxBackups < 1 {
+		maxBackups = 1
+	}
+
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+
+	return nil
+}
+
+// Write appends b, rotating first if b would take the file past maxSize. A
+// write is never split across files. If rotating fails the file is opened
+// again, as it was left, and b still written so no record is lost.
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			slog.Error("failed to rotate audit log", "path", r.path, "err", err)
+		}
+	}
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, fmt.Errorf("failed to reopen %s; %v", r.path, err)
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// rotate closes the file and shifts it into the backups. Write opens the
+// file at path again, whether that worked or not.
+func (r *RotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+
+	if err != nil {
+		return err
+	}
+
+	os.Remove(r.backup(r.maxBackups))
+
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(r.backup(i), r.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(r.path, r.backup(1))
+}
+
+func (r *RotatingFile) backup(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+func (r *RotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+
+	return r.f.Close()
+}
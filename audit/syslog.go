@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// DialSyslog connects to a syslog daemon, the local one if network and addr
+// are empty, and sends each record as an info message of the authpriv facility.
+func DialSyslog(network, addr, tag string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, tag)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks a downstream login before it is allowed to use the
+// cached upstream session.
+type Authenticator interface {
+	Authenticate(clID, pw string) bool
+}
+
+// CredentialStore authenticates downstream clients against bcrypt password
+// hashes from the config.
+type CredentialStore struct {
+	hashes map[string][]byte
+}
+
+// dummyHash is compared against for unknown clIDs so that a miss takes as
+// long as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("epplb"), bcrypt.DefaultCost)
+
+func NewCredentialStore(clients []ClientConfig) (*CredentialStore, error) {
+	s := &CredentialStore{hashes: make(map[string][]byte)}
+
+	for _, client := range clients {
+		hash := []byte(client.PasswordHash)
+
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("invalid password hash; clid=%s, err=%v", client.ClID, err)
+		}
+
+		s.hashes[client.ClID] = hash
+	}
+
+	return s, nil
+}
+
+func (s *CredentialStore) Authenticate(clID, pw string) bool {
+	hash, ok := s.hashes[clID]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pw))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(pw)) == nil
+}
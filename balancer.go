@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+// dialTimeout keeps an unreachable endpoint from holding up a dial for the
+// operating system's much longer connect timeout.
+const dialTimeout = 30 * time.Second
+
+// endpoint is one registry server and the connections open to it.
+type endpoint struct {
+	address      string
+	priority     int
+	conns        map[*endpointConn]bool
+	ejectedUntil time.Time
+	ejections    uint64
+}
+
+// balancer dials whichever endpoint its strategy picks. Endpoints that fail
+// to connect, greet or log in are ejected for a while; if every endpoint is
+// ejected the one due back soonest is tried anyway.
+type balancer struct {
+	name      string
+	strategy  string
+	ejectFor  time.Duration
+	tlsConfig *tls.Config
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+func newBalancer(name string, config *UpstreamConfig) (*balancer, error) {
+	tlsConfig, err := loadTlsConfig(config.TLS.Cert, config.TLS.Key, config.TLS.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &balancer{
+		name:      name,
+		strategy:  config.Balance,
+		ejectFor:  time.Duration(config.EjectFor),
+		tlsConfig: tlsConfig,
+	}
+
+	for _, e := range config.EndpointConfigs() {
+		b.endpoints = append(b.endpoints, &endpoint{
+			address:  e.Address,
+			priority: e.Priority,
+			conns:    make(map[*endpointConn]bool),
+		})
+	}
+
+	return b, nil
+}
+
+// Dial connects to the picked endpoint, moving on to the next pick each time
+// one fails until every endpoint has been tried once.
+func (b *balancer) Dial() (net.Conn, error) {
+	var lastErr error
+
+	tried := make(map[*endpoint]bool, len(b.endpoints))
+
+	for len(tried) < len(b.endpoints) {
+		e := b.pick(tried)
+		tried[e] = true
+
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", e.address, b.tlsConfig)
+		if err != nil {
+			b.eject(e, err)
+			lastErr = err
+			continue
+		}
+
+		ec := &endpointConn{Conn: conn, balancer: b, endpoint: e}
+
+		b.mu.Lock()
+		e.conns[ec] = true
+		b.mu.Unlock()
+
+		return ec, nil
+	}
+
+	return nil, fmt.Errorf("no endpoint could be reached; %v", lastErr)
+}
+
+// pick chooses an endpoint that hasn't been tried yet, preferring ones that
+// aren't ejected.
+func (b *balancer) pick(tried map[*endpoint]bool) *endpoint {
+	var load map[*endpoint]int
+	if b.strategy == BalanceLeastOutstanding {
+		load = b.outstanding()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	var candidates []*endpoint
+	for _, e := range b.endpoints {
+		if !tried[e] && !now.Before(e.ejectedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	if len(candidates) == 0 {
+		var soonest *endpoint
+		for _, e := range b.endpoints {
+			if !tried[e] && (soonest == nil || e.ejectedUntil.Before(soonest.ejectedUntil)) {
+				soonest = e
+			}
+		}
+		return soonest
+	}
+
+	switch b.strategy {
+	case BalanceLeastOutstanding:
+		best := candidates[0]
+		for _, e := range candidates[1:] {
+			if load[e] < load[best] || (load[e] == load[best] && len(e.conns) < len(best.conns)) {
+				best = e
+			}
+		}
+		return best
+	case BalanceFailover:
+		top := candidates[:0:0]
+		for _, e := range candidates {
+			if len(top) == 0 || e.priority < top[0].priority {
+				top = []*endpoint{e}
+			} else if e.priority == top[0].priority {
+				top = append(top, e)
+			}
+		}
+		candidates = top
+	}
+
+	b.next++
+
+	return candidates[b.next%len(candidates)]
+}
+
+// outstanding is the number of commands waiting on each endpoint's sessions.
+// A failing session holds its own lock while it closes its conn, which takes
+// the balancer's, so sessions are only asked once the balancer's lock is
+// released.
+func (b *balancer) outstanding() map[*endpoint]int {
+	sessions := make(map[*endpoint][]*epp.Client)
+
+	b.mu.Lock()
+	for _, e := range b.endpoints {
+		for conn := range e.conns {
+			if conn.client != nil {
+				sessions[e] = append(sessions[e], conn.client)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	load := make(map[*endpoint]int, len(sessions))
+	for e, clients := range sessions {
+		for _, c := range clients {
+			load[e] += c.Pending()
+		}
+	}
+
+	return load
+}
+
+func (b *balancer) eject(e *endpoint, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.ejectedUntil = time.Now().Add(b.ejectFor)
+	e.ejections++
+
+	slog.Warn("ejecting upstream endpoint", "proxy", b.name, "address", e.address, "for", b.ejectFor, "err", err)
+}
+
+// EndpointHealth is the state of one upstream endpoint.
+type EndpointHealth struct {
+	Address      string `json:"address"`
+	Ejected      bool   `json:"ejected"`
+	EjectedUntil string `json:"ejected_until,omitempty"`
+	Ejections    uint64 `json:"ejections"`
+	Conns        int    `json:"conns"`
+	Outstanding  int    `json:"outstanding"`
+}
+
+func (b *balancer) Health() []EndpointHealth {
+	load := b.outstanding()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	out := make([]EndpointHealth, len(b.endpoints))
+
+	for i, e := range b.endpoints {
+		out[i] = EndpointHealth{
+			Address:     e.address,
+			Ejected:     now.Before(e.ejectedUntil),
+			Ejections:   e.ejections,
+			Conns:       len(e.conns),
+			Outstanding: load[e],
+		}
+
+		if out[i].Ejected {
+			out[i].EjectedUntil = e.ejectedUntil.Format(time.RFC3339)
+		}
+	}
+
+	return out
+}
+
+// endpointConn is a connection made by a balancer. It remembers its endpoint
+// so the session running over it can be counted and blamed.
+type endpointConn struct {
+	net.Conn
+	balancer *balancer
+	endpoint *endpoint
+	client   *epp.Client
+	once     sync.Once
+}
+
+func (c *endpointConn) Close() error {
+	c.once.Do(func() {
+		c.balancer.mu.Lock()
+		delete(c.endpoint.conns, c)
+		c.balancer.mu.Unlock()
+	})
+
+	return c.Conn.Close()
+}
+
+// trackSession tells the balancer which session runs over conn, so its
+// outstanding commands count toward the endpoint.
+func trackSession(conn net.Conn, c *epp.Client) {
+	if ec, ok := conn.(*endpointConn); ok {
+		ec.balancer.mu.Lock()
+		ec.client = c
+		ec.balancer.mu.Unlock()
+	}
+}
+
+// ejectEndpoint ejects the endpoint a session that failed to greet or log in
+// was connected to.
+func ejectEndpoint(conn net.Conn, err error) {
+	if ec, ok := conn.(*endpointConn); ok {
+		ec.balancer.eject(ec.endpoint, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+// testBalancer makes a balancer over fake endpoints, one per priority given,
+// named a, b, c and so on. Nothing is dialled.
+func testBalancer(strategy string, priorities ...int) *balancer {
+	b := &balancer{name: "test", strategy: strategy, ejectFor: time.Minute}
+
+	for i, priority := range priorities {
+		b.endpoints = append(b.endpoints, &endpoint{
+			address:  string(rune('a' + i)),
+			priority: priority,
+			conns:    make(map[*endpointConn]bool),
+		})
+	}
+
+	return b
+}
+
+// picks returns the addresses of n picks in a row.
+func picks(b *balancer, n int) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		s += b.pick(nil).address
+	}
+
+	return s
+}
+
+// addConns gives e n idle connections.
+func addConns(e *endpoint, n int) {
+	for i := 0; i < n; i++ {
+		e.conns[&endpointConn{endpoint: e}] = true
+	}
+}
+
+// busyClient returns a session with n commands waiting on a registry that
+// never answers.
+func busyClient(t *testing.T, n int) *epp.Client {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+
+	go func() {
+		epp.NewConn(server).WriteFrame(epp.FrameFromString(testGreeting))
+		io.Copy(io.Discard, server)
+	}()
+
+	c := epp.NewClient(client, epp.KeepaliveInterval(0))
+	t.Cleanup(func() { c.Close() })
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed with %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		go c.Hello()
+	}
+
+	for deadline := time.Now().Add(time.Second); c.Pending() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pending commands, got %d", n, c.Pending())
+		}
+	}
+
+	return c
+}
+
+func TestPick(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		strategy   string
+		priorities []int
+		ejected    []int
+		picks      string
+	}{
+		{"round robin", BalanceRoundRobin, []int{0, 0, 0}, nil, "bcabca"},
+		{"round robin skips ejected", BalanceRoundRobin, []int{0, 0, 0}, []int{1}, "cacaca"},
+		{"failover uses the lowest priority", BalanceFailover, []int{2, 1, 1}, nil, "cbcbcb"},
+		{"failover falls back", BalanceFailover, []int{2, 1, 1}, []int{1, 2}, "aaaaaa"},
+		{"failover to the next priority", BalanceFailover, []int{3, 1, 2}, []int{1}, "cccccc"},
+	} {
+		b := testBalancer(tc.strategy, tc.priorities...)
+
+		for _, i := range tc.ejected {
+			b.eject(b.endpoints[i], io.EOF)
+		}
+
+		if s := picks(b, len(tc.picks)); s != tc.picks {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.picks, s)
+		}
+	}
+}
+
+func TestPickLeastOutstanding(t *testing.T) {
+	b := testBalancer(BalanceLeastOutstanding, 0, 0, 0)
+	a, c := b.endpoints[0], b.endpoints[2]
+
+	// a has the fewest connections but a command waiting, so b and c are
+	// idle and b, with fewer connections, wins.
+	a.conns[&endpointConn{endpoint: a, client: busyClient(t, 1)}] = true
+	addConns(b.endpoints[1], 2)
+	addConns(c, 3)
+
+	if s := picks(b, 3); s != "bbb" {
+		t.Errorf("Expected b every time, got %s", s)
+	}
+
+	// Commands outstanding count for more than connections open.
+	addConns(b.endpoints[1], 2)
+	c.conns[&endpointConn{endpoint: c, client: busyClient(t, 2)}] = true
+
+	if s := picks(b, 3); s != "bbb" {
+		t.Errorf("Expected b with no commands outstanding, got %s", s)
+	}
+
+	b.endpoints[1].conns[&endpointConn{endpoint: b.endpoints[1], client: busyClient(t, 3)}] = true
+
+	if s := picks(b, 3); s != "aaa" {
+		t.Errorf("Expected a with the fewest commands outstanding, got %s", s)
+	}
+}
+
+func TestPickSkipsTried(t *testing.T) {
+	b := testBalancer(BalanceRoundRobin, 0, 0, 0)
+
+	tried := map[*endpoint]bool{b.endpoints[0]: true, b.endpoints[1]: true}
+
+	for i := 0; i < 3; i++ {
+		if e := b.pick(tried); e != b.endpoints[2] {
+			t.Errorf("Expected the only endpoint not yet tried, got %s", e.address)
+		}
+	}
+}
+
+func TestEject(t *testing.T) {
+	b := testBalancer(BalanceRoundRobin, 0, 0)
+
+	b.eject(b.endpoints[0], io.EOF)
+	b.eject(b.endpoints[0], io.EOF)
+
+	health := b.Health()
+
+	if !health[0].Ejected || health[0].Ejections != 2 || health[0].EjectedUntil == "" {
+		t.Errorf("Expected a to be ejected twice, got %+v", health[0])
+	}
+
+	if health[1].Ejected || health[1].Ejections != 0 {
+		t.Errorf("Expected b not to be ejected, got %+v", health[1])
+	}
+
+	// Once its time is up the endpoint is picked again.
+	b.endpoints[0].ejectedUntil = time.Now().Add(-time.Second)
+
+	if s := picks(b, 4); s != "baba" {
+		t.Errorf("Expected a back in rotation, got %s", s)
+	}
+}
+
+func TestPickAllEjectedSoonest(t *testing.T) {
+	b := testBalancer(BalanceRoundRobin, 0, 0, 0)
+
+	now := time.Now()
+	b.endpoints[0].ejectedUntil = now.Add(3 * time.Minute)
+	b.endpoints[1].ejectedUntil = now.Add(time.Minute)
+	b.endpoints[2].ejectedUntil = now.Add(2 * time.Minute)
+
+	if e := b.pick(nil); e != b.endpoints[1] {
+		t.Errorf("Expected b, due back soonest, got %s", e.address)
+	}
+
+	if e := b.pick(map[*endpoint]bool{b.endpoints[1]: true}); e != b.endpoints[2] {
+		t.Errorf("Expected c, due back soonest of those not tried, got %s", e.address)
+	}
+}
+
+func TestHealthWhileSessionFails(t *testing.T) {
+	b := testBalancer(BalanceLeastOutstanding, 0)
+	e := b.endpoints[0]
+
+	for i := 0; i < 50; i++ {
+		client, server := net.Pipe()
+
+		ec := &endpointConn{Conn: client, balancer: b, endpoint: e}
+		e.conns[ec] = true
+
+		c := epp.NewClient(ec, epp.KeepaliveInterval(0), epp.Pipeline(4))
+		trackSession(ec, c)
+
+		registry := epp.NewConn(server)
+		go registry.WriteFrame(epp.FrameFromString(testGreeting))
+
+		if _, err := c.Connect(); err != nil {
+			t.Fatalf("Connect failed with %v", err)
+		}
+
+		for j := 0; j < 4; j++ {
+			go c.Hello()
+		}
+
+		// The session fails, closing its conn, while health is being
+		// reported and endpoints picked.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-c.Done():
+					return
+				default:
+					b.Health()
+					b.pick(nil)
+				}
+			}
+		}()
+
+		registry.ReadFrame()
+		server.Close()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected health to be reported while a session fails, but it hung")
+		}
+	}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/policy"
+	"github.com/davidrjonas/epplb/xsd"
+)
+
+// Duration is a time.Duration that reads from config as a string such as
+// "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+type Config struct {
+	Log     LogConfig     `yaml:"log"`
+	Admin   AdminConfig   `yaml:"admin"`
+	Audit   *AuditConfig  `yaml:"audit"`
+	Proxies []ProxyConfig `yaml:"proxies"`
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogConfig picks how log lines are written: Format is text (logfmt) or
+// json, and Level is the least severe level written, one of debug, info,
+// warn or error.
+type LogConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+// AdminConfig is the HTTP listener for stats. It is off without a listen
+// address.
+type AdminConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// AuditConfig sends a record of every command sent upstream, and the
+// response, to either a file or syslog.
+type AuditConfig struct {
+	File   *AuditFileConfig   `yaml:"file"`
+	Syslog *AuditSyslogConfig `yaml:"syslog"`
+}
+
+// AuditFileConfig is a file that is rotated once it passes MaxSizeMB,
+// keeping MaxBackups old files. A MaxSizeMB of 0 never rotates.
+type AuditFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// AuditSyslogConfig is a syslog daemon. Without a network and address it is
+// the local one.
+type AuditSyslogConfig struct {
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// ProxyConfig describes one named proxy: a listener and the upstream
+// registry its clients are sent to. MaxFrameSize limits the frames, in bytes
+// and header included, read from or written to clients and the registry.
+type ProxyConfig struct {
+	Name         string           `yaml:"name"`
+	Listen       string           `yaml:"listen"`
+	MaxRetries   uint8            `yaml:"max_retries"`
+	MaxFrameSize uint32           `yaml:"max_frame_size"`
+	Upstream     UpstreamConfig   `yaml:"upstream"`
+	Downstream   DownstreamConfig `yaml:"downstream"`
+	Clients      []ClientConfig   `yaml:"clients"`
+	HTTP         *HTTPConfig      `yaml:"http"`
+	Policy       *PolicyConfig    `yaml:"policy"`
+}
+
+// HTTPConfig turns on the EPP-over-HTTP gateway for a proxy.
+type HTTPConfig struct {
+	Listen  string           `yaml:"listen"`
+	Timeout Duration         `yaml:"timeout"`
+	TLS     *ServerTLSConfig `yaml:"tls"`
+}
+
+func (c *HTTPConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = HTTPConfig{Timeout: Duration(time.Minute)}
+
+	type plain HTTPConfig
+	return unmarshal((*plain)(c))
+}
+
+// UnmarshalYAML fills in the defaults before reading a proxy so that each
+// entry of the proxies list only needs the keys that differ.
+func (p *ProxyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*p = *DefaultProxyConfig()
+
+	type plain ProxyConfig
+	return unmarshal((*plain)(p))
+}
+
+// UpstreamConfig is the registry a proxy connects to. Endpoints, when given,
+// replace Address and sessions are spread over them according to Balance.
+type UpstreamConfig struct {
+	Address           string             `yaml:"address"`
+	Endpoints         []EndpointConfig   `yaml:"endpoints"`
+	Balance           string             `yaml:"balance"`
+	EjectFor          Duration           `yaml:"eject_for"`
+	TLS               TLSConfig          `yaml:"tls"`
+	Pool              PoolConfig         `yaml:"pool"`
+	KeepaliveInterval Duration           `yaml:"keepalive_interval"`
+	Timeouts          TimeoutsConfig     `yaml:"timeouts"`
+	Multiplex         *MultiplexConfig   `yaml:"multiplex"`
+	HealthCheck       *HealthCheckConfig `yaml:"health_check"`
+}
+
+// EndpointConfig is one of a registry's EPP servers. With the failover
+// balance the lowest Priority endpoints are used while any of them are up.
+type EndpointConfig struct {
+	Address  string `yaml:"address"`
+	Priority int    `yaml:"priority"`
+}
+
+// Balance strategies for choosing an upstream endpoint.
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastOutstanding = "least_outstanding"
+	BalanceFailover         = "failover"
+)
+
+// HealthCheckConfig sends a hello, or Command once logged in, on each idle
+// upstream session every Interval. Sessions that fail, or get no answer
+// within the upstream idle timeout, are replaced.
+type HealthCheckConfig struct {
+	Interval Duration `yaml:"interval"`
+	Command  string   `yaml:"command"`
+}
+
+// MultiplexConfig shares the pool's upstream sessions between downstream
+// clients instead of giving each client its own. Pipeline is how many
+// commands may be outstanding on one session; 1 sends them one at a time.
+type MultiplexConfig struct {
+	Pipeline int `yaml:"pipeline"`
+}
+
+type DownstreamConfig struct {
+	Timeouts   TimeoutsConfig    `yaml:"timeouts"`
+	TLS        *ServerTLSConfig  `yaml:"tls"`
+	Validation *ValidationConfig `yaml:"validation"`
+}
+
+// ValidationConfig turns on checking client frames against the EPP schemas
+// before they go upstream. ExtensionSchemas is a directory of .xsd files for
+// the extensions the registry supports beyond secDNS and rgp.
+type ValidationConfig struct {
+	ExtensionSchemas string `yaml:"extension_schemas"`
+}
+
+// ServerTLSConfig turns on TLS for a downstream listener. With a client CA
+// clients must authenticate with a certificate, and identities maps a
+// certificate subject such as "CN=client1,O=Example" to the only clID that
+// certificate may log in as.
+type ServerTLSConfig struct {
+	Cert         string            `yaml:"cert"`
+	Key          string            `yaml:"key"`
+	ClientCA     string            `yaml:"client_ca"`
+	MinVersion   string            `yaml:"min_version"`
+	CipherSuites []string          `yaml:"cipher_suites"`
+	Identities   map[string]string `yaml:"identities"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+}
+
+// PoolConfig sizes a pool of upstream sessions. MinIdle sessions are kept
+// open and logged in sessions go back to the pool between clients. Once
+// MaxOpen are open, clients wait up to WaitTimeout for one to come back.
+type PoolConfig struct {
+	MinIdle     int      `yaml:"min_idle"`
+	MaxOpen     int      `yaml:"max_open"`
+	WaitTimeout Duration `yaml:"wait_timeout"`
+}
+
+// TimeoutsConfig limits reads and writes on a connection. Logout only applies
+// upstream and limits how long shutdown waits for each session's logout;
+// zero closes sessions without logging out.
+type TimeoutsConfig struct {
+	Read   Duration `yaml:"read"`
+	Write  Duration `yaml:"write"`
+	Idle   Duration `yaml:"idle"`
+	Logout Duration `yaml:"logout"`
+}
+
+// PolicyConfig decides which commands logged in clients may send. The first
+// rule matching a command decides it and Default, allow or deny, decides
+// those none match. It is read again on SIGHUP.
+type PolicyConfig struct {
+	Default string             `yaml:"default"`
+	Rules   []PolicyRuleConfig `yaml:"rules"`
+}
+
+// PolicyRuleConfig matches commands by the clID the client logged in with,
+// the command, the object type or namespace, the TLD of the objects and the
+// extensions used. Action is allow, deny or confirm; the latter only allows
+// a command sent through the HTTP gateway with an X-EPP-Confirm header naming
+// it. Denied commands get Code and Message, 2201 "Authorization error" by
+// default.
+type PolicyRuleConfig struct {
+	Clients    []string `yaml:"clients"`
+	Commands   []string `yaml:"commands"`
+	Objects    []string `yaml:"objects"`
+	TLDs       []string `yaml:"tlds"`
+	Extensions []string `yaml:"extensions"`
+	Action     string   `yaml:"action"`
+	Code       uint16   `yaml:"code"`
+	Message    string   `yaml:"message"`
+}
+
+// PolicyRules converts the config for policy.New and Policy.Update.
+func (c *PolicyConfig) PolicyRules() ([]policy.Rule, policy.Action) {
+	if c == nil {
+		return nil, policy.Allow
+	}
+
+	rules := make([]policy.Rule, len(c.Rules))
+
+	for i, r := range c.Rules {
+		rules[i] = policy.Rule{
+			Clients:    r.Clients,
+			Commands:   r.Commands,
+			Objects:    r.Objects,
+			TLDs:       r.TLDs,
+			Extensions: r.Extensions,
+			Action:     policy.Action(r.Action),
+			Code:       r.Code,
+			Message:    r.Message,
+		}
+	}
+
+	return rules, policy.Action(c.Default)
+}
+
+// ClientConfig is a downstream client allowed to log in to the proxy.
+type ClientConfig struct {
+	ClID         string         `yaml:"clid"`
+	PasswordHash string         `yaml:"password_hash"`
+	Registry     *AccountConfig `yaml:"registry"`
+}
+
+// AccountConfig is the real registry account a downstream client's sessions
+// are logged in with. Each account gets its own pool.
+type AccountConfig struct {
+	ClID     string     `yaml:"clid"`
+	Password string     `yaml:"password"`
+	Pool     PoolConfig `yaml:"pool"`
+}
+
+func (a *AccountConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*a = AccountConfig{Pool: PoolConfig{MinIdle: 0, MaxOpen: 1, WaitTimeout: Duration(30 * time.Second)}}
+
+	type plain AccountConfig
+	return unmarshal((*plain)(a))
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Log:     LogConfig{Format: LogFormatText, Level: "info"},
+		Proxies: []ProxyConfig{*DefaultProxyConfig()},
+	}
+}
+
+func DefaultProxyConfig() *ProxyConfig {
+	return &ProxyConfig{
+		Name:         "default",
+		Listen:       ":10700",
+		MaxRetries:   3,
+		MaxFrameSize: epp.DefaultMaxFrameSize,
+		Upstream: UpstreamConfig{
+			Address:  "epp-ote.verisign-grs.com:700",
+			Balance:  BalanceRoundRobin,
+			EjectFor: Duration(30 * time.Second),
+			TLS: TLSConfig{
+				Cert: "crt.pem",
+				Key:  "key.pem",
+				CA:   "ca.pem",
+			},
+			Pool:              PoolConfig{MinIdle: 1, MaxOpen: 1, WaitTimeout: Duration(30 * time.Second)},
+			KeepaliveInterval: Duration(5 * time.Minute),
+			Timeouts: TimeoutsConfig{
+				Read:   Duration(30 * time.Second),
+				Write:  Duration(30 * time.Second),
+				Idle:   Duration(2 * time.Minute),
+				Logout: Duration(5 * time.Second),
+			},
+		},
+		Downstream: DownstreamConfig{
+			Timeouts: TimeoutsConfig{
+				Read:  Duration(30 * time.Second),
+				Write: Duration(30 * time.Second),
+				Idle:  Duration(5 * time.Minute),
+			},
+		},
+	}
+}
+
+// LoadConfig reads a YAML config file over the defaults. Unknown keys are an
+// error so typos don't silently fall back to a default.
+func LoadConfig(filename string) (*Config, error) {
+	config := DefaultConfig()
+
+	if filename == "" {
+		return config, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config; filename=%s, err=%v", filename, err)
+	}
+
+	return config, nil
+}
+
+// Validate checks the config for mistakes that would otherwise only show up
+// once the proxies are running. It reads the TLS material but opens no
+// sockets.
+func (c *Config) Validate() error {
+	if err := c.Log.validate(); err != nil {
+		return fmt.Errorf("log: %v", err)
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			return fmt.Errorf("admin: invalid listen address; %v", err)
+		}
+	}
+
+	if c.Audit != nil {
+		if err := c.Audit.validate(); err != nil {
+			return fmt.Errorf("audit: %v", err)
+		}
+	}
+
+	if len(c.Proxies) == 0 {
+		return errors.New("at least one proxy is required")
+	}
+
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+
+		if p.Name == "" {
+			return fmt.Errorf("proxies[%d]: name is required", i)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("proxies[%d]: duplicate name %s", i, p.Name)
+		}
+		names[p.Name] = true
+
+		if listens[p.Listen] {
+			return fmt.Errorf("proxy %s: listen address %s is already used", p.Name, p.Listen)
+		}
+		listens[p.Listen] = true
+
+		if p.HTTP != nil {
+			if listens[p.HTTP.Listen] {
+				return fmt.Errorf("proxy %s: http listen address %s is already used", p.Name, p.HTTP.Listen)
+			}
+			listens[p.HTTP.Listen] = true
+		}
+
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("proxy %s: %v", p.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *ProxyConfig) validate() error {
+	if c.Listen == "" {
+		return errors.New("listen is required")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address; %v", err)
+	}
+
+	// A frame is at least its four byte header.
+	if c.MaxFrameSize <= 4 {
+		return fmt.Errorf("max_frame_size must be more than 4; max_frame_size=%d", c.MaxFrameSize)
+	}
+
+	if err := c.Upstream.validate(); err != nil {
+		return fmt.Errorf("upstream: %v", err)
+	}
+
+	if err := c.Downstream.validate(); err != nil {
+		return fmt.Errorf("downstream: %v", err)
+	}
+
+	if c.HTTP != nil {
+		if err := c.HTTP.validate(); err != nil {
+			return fmt.Errorf("http: %v", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, client := range c.Clients {
+		if client.ClID == "" {
+			return fmt.Errorf("clients[%d]: clid is required", i)
+		}
+
+		if seen[client.ClID] {
+			return fmt.Errorf("clients[%d]: duplicate clid %s", i, client.ClID)
+		}
+		seen[client.ClID] = true
+
+		if client.PasswordHash == "" {
+			return fmt.Errorf("clients[%d]: password_hash is required", i)
+		}
+
+		if client.Registry != nil {
+			if err := client.Registry.validate(); err != nil {
+				return fmt.Errorf("clients[%d]: registry: %v", i, err)
+			}
+		}
+	}
+
+	if _, err := NewCredentialStore(c.Clients); err != nil {
+		return err
+	}
+
+	if c.Policy != nil {
+		if _, err := policy.New(c.Policy.PolicyRules()); err != nil {
+			return fmt.Errorf("policy: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// EndpointConfigs returns the endpoints to balance over, which is just
+// Address when none are listed.
+func (c *UpstreamConfig) EndpointConfigs() []EndpointConfig {
+	if len(c.Endpoints) > 0 {
+		return c.Endpoints
+	}
+
+	return []EndpointConfig{{Address: c.Address}}
+}
+
+func (c *UpstreamConfig) validate() error {
+	if c.Address == "" && len(c.Endpoints) == 0 {
+		return errors.New("address or endpoints are required")
+	}
+
+	for _, endpoint := range c.EndpointConfigs() {
+		if _, _, err := net.SplitHostPort(endpoint.Address); err != nil {
+			return fmt.Errorf("invalid address; %v", err)
+		}
+	}
+
+	switch c.Balance {
+	case BalanceRoundRobin, BalanceLeastOutstanding, BalanceFailover:
+	default:
+		return fmt.Errorf("unknown balance; balance=%s", c.Balance)
+	}
+
+	if c.EjectFor < 0 {
+		return errors.New("eject_for must not be negative")
+	}
+
+	if _, err := loadTlsConfig(c.TLS.Cert, c.TLS.Key, c.TLS.CA); err != nil {
+		return err
+	}
+
+	if err := c.Pool.validate(); err != nil {
+		return err
+	}
+
+	if c.KeepaliveInterval < 0 {
+		return errors.New("keepalive_interval must not be negative")
+	}
+
+	if c.Multiplex != nil && c.Multiplex.Pipeline < 1 {
+		return errors.New("multiplex pipeline must be at least 1")
+	}
+
+	if c.HealthCheck != nil {
+		if err := c.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+
+	return c.Timeouts.validate()
+}
+
+func (c *HealthCheckConfig) validate() error {
+	if c.Interval <= 0 {
+		return errors.New("health_check interval must be positive")
+	}
+
+	if c.Command == "" {
+		return nil
+	}
+
+	if !wellFormed([]byte(c.Command)) {
+		return errors.New("health_check command is not well-formed XML")
+	}
+
+	switch epp.FrameFromString(c.Command).GetCommand() {
+	case "":
+		return errors.New("health_check command is not an EPP command")
+	case "login", "logout":
+		return errors.New("health_check command must not be a login or logout")
+	}
+
+	return nil
+}
+
+func (c *DownstreamConfig) validate() error {
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+
+	if c.Validation != nil {
+		if _, err := xsd.Load(c.Validation.ExtensionSchemas); err != nil {
+			return fmt.Errorf("validation: %v", err)
+		}
+	}
+
+	if c.TLS == nil {
+		return nil
+	}
+
+	return c.TLS.validate()
+}
+
+func (c *HTTPConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address; %v", err)
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+
+	if c.TLS == nil {
+		return nil
+	}
+
+	return c.TLS.validate()
+}
+
+func (c *ServerTLSConfig) validate() error {
+	if len(c.Identities) > 0 && c.ClientCA == "" {
+		return errors.New("tls identities need a client_ca")
+	}
+
+	_, err := loadServerTlsConfig(c)
+
+	return err
+}
+
+func (c *AccountConfig) validate() error {
+	if c.ClID == "" || c.Password == "" {
+		return errors.New("clid and password are required")
+	}
+
+	return c.Pool.validate()
+}
+
+func (c *PoolConfig) validate() error {
+	if c.MaxOpen < 1 {
+		return errors.New("pool max_open must be at least 1")
+	}
+
+	if c.MinIdle < 0 || c.MinIdle > c.MaxOpen {
+		return errors.New("pool min_idle must be between 0 and max_open")
+	}
+
+	if c.WaitTimeout < 0 {
+		return errors.New("pool wait_timeout must not be negative")
+	}
+
+	return nil
+}
+
+func (c *LogConfig) validate() error {
+	switch c.Format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown format; format=%s", c.Format)
+	}
+
+	if _, err := parseLogLevel(c.Level); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *AuditConfig) validate() error {
+	if (c.File == nil) == (c.Syslog == nil) {
+		return errors.New("exactly one of file or syslog is required")
+	}
+
+	if c.File != nil {
+		if c.File.Path == "" {
+			return errors.New("file path is required")
+		}
+
+		if c.File.MaxSizeMB < 0 || c.File.MaxBackups < 0 {
+			return errors.New("file max_size_mb and max_backups must not be negative")
+		}
+
+		if c.File.MaxSizeMB > 0 && c.File.MaxBackups < 1 {
+			return errors.New("file max_backups must be at least 1 when max_size_mb is set")
+		}
+	}
+
+	if c.Syslog != nil && (c.Syslog.Network == "") != (c.Syslog.Address == "") {
+		return errors.New("syslog network and address go together")
+	}
+
+	return nil
+}
+
+func (c *TimeoutsConfig) validate() error {
+	if c.Read < 0 || c.Write < 0 || c.Idle < 0 || c.Logout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+
+	return nil
+}
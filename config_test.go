@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate for CN=client1,O=Example, written out as PEM files.
+type testPKI struct {
+	CA, Cert, Key, ClientCert, ClientKey string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPKI{CA: filepath.Join(dir, "ca.pem")}
+	writePEM(t, p.CA, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, subject pkix.Name, usage x509.ExtKeyUsage, ips []net.IP) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+
+		return certFile, keyFile
+	}
+
+	p.Cert, p.Key = issue("server", 2, pkix.Name{CommonName: "127.0.0.1"}, x509.ExtKeyUsageServerAuth, []net.IP{net.IPv4(127, 0, 0, 1)})
+	p.ClientCert, p.ClientKey = issue("client", 3, pkix.Name{CommonName: "client1", Organization: []string{"Example"}}, x509.ExtKeyUsageClientAuth, nil)
+
+	return p
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "epplb.yml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// validConfig is the default config with its upstream TLS files made real.
+func validConfig(t *testing.T) *Config {
+	pki := newTestPKI(t)
+
+	c := DefaultConfig()
+	c.Proxies[0].Upstream.TLS = TLSConfig{Cert: pki.ClientCert, Key: pki.ClientKey, CA: pki.CA}
+
+	return c
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `
+proxies:
+  - name: a
+    listen: ":10701"
+  - name: b
+    listen: ":10702"
+    max_frame_size: 65536
+    upstream:
+      pool:
+        max_open: 4
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed with %v", err)
+	}
+
+	if c.Log.Format != LogFormatText || c.Log.Level != "info" {
+		t.Errorf("Expected the default log settings, got %+v", c.Log)
+	}
+
+	if len(c.Proxies) != 2 {
+		t.Fatalf("Expected 2 proxies, got %d", len(c.Proxies))
+	}
+
+	a, b := c.Proxies[0], c.Proxies[1]
+
+	if a.MaxRetries != 3 || a.MaxFrameSize != epp.DefaultMaxFrameSize || a.Upstream.Address != "epp-ote.verisign-grs.com:700" {
+		t.Errorf("Expected proxy a to get the defaults, got %+v", a)
+	}
+
+	if b.MaxFrameSize != 65536 {
+		t.Errorf("Expected max_frame_size 65536, got %d", b.MaxFrameSize)
+	}
+
+	// Keys left out of a nested section keep their defaults too.
+	if b.Upstream.Pool.MaxOpen != 4 || b.Upstream.Pool.MinIdle != 1 || b.Upstream.Timeouts.Read != Duration(30*time.Second) {
+		t.Errorf("Expected max_open 4 over the other defaults, got %+v and %+v", b.Upstream.Pool, b.Upstream.Timeouts)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	c, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig failed with %v", err)
+	}
+
+	if len(c.Proxies) != 1 || c.Proxies[0].Name != "default" {
+		t.Errorf("Expected the default proxy, got %+v", c.Proxies)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `
+proxies:
+  - name: a
+    listne: ":10701"
+`))
+	if err == nil || !strings.Contains(err.Error(), "listne") {
+		t.Errorf("Expected an error naming the unknown key, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig(t).Validate(); err != nil {
+		t.Fatalf("Expected the config to be valid, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"no proxies", func(c *Config) { c.Proxies = nil }, "at least one proxy"},
+		{"log format", func(c *Config) { c.Log.Format = "xml" }, "log: unknown format"},
+		{"duplicate name", func(c *Config) {
+			c.Proxies = append(c.Proxies, c.Proxies[0])
+			c.Proxies[1].Listen = ":10701"
+		}, "duplicate name default"},
+		{"duplicate listen", func(c *Config) {
+			c.Proxies = append(c.Proxies, c.Proxies[0])
+			c.Proxies[1].Name = "other"
+		}, "listen address :10700 is already used"},
+		{"listen address", func(c *Config) { c.Proxies[0].Listen = "10700" }, "invalid listen address"},
+		{"max frame size", func(c *Config) { c.Proxies[0].MaxFrameSize = 4 }, "max_frame_size must be more than 4"},
+		{"balance", func(c *Config) { c.Proxies[0].Upstream.Balance = "random" }, "unknown balance"},
+		{"upstream tls", func(c *Config) { c.Proxies[0].Upstream.TLS.CA = "missing.pem" }, "failed to load ca file"},
+		{"pool", func(c *Config) { c.Proxies[0].Upstream.Pool.MinIdle = 2 }, "min_idle must be between 0 and max_open"},
+		{"timeouts", func(c *Config) { c.Proxies[0].Downstream.Timeouts.Idle = -1 }, "downstream: timeouts must not be negative"},
+		{"client without hash", func(c *Config) { c.Proxies[0].Clients = []ClientConfig{{ClID: "client1"}} }, "password_hash is required"},
+		{"identities without client ca", func(c *Config) {
+			c.Proxies[0].Downstream.TLS = &ServerTLSConfig{Identities: map[string]string{"CN=client1": "client1"}}
+		}, "tls identities need a client_ca"},
+		{"http identities without client ca", func(c *Config) {
+			c.Proxies[0].HTTP = &HTTPConfig{Listen: ":8700", Timeout: Duration(time.Second), TLS: &ServerTLSConfig{Identities: map[string]string{"CN=client1": "client1"}}}
+		}, "http: tls identities need a client_ca"},
+		{"audit backups", func(c *Config) {
+			c.Audit = &AuditConfig{File: &AuditFileConfig{Path: "audit.log", MaxSizeMB: 10}}
+		}, "max_backups must be at least 1"},
+		{"policy", func(c *Config) {
+			c.Proxies[0].Policy = &PolicyConfig{Rules: []PolicyRuleConfig{{Action: "maybe"}}}
+		}, "policy: rules[0]: unknown action"},
+	} {
+		c := validConfig(t)
+		tc.change(c)
+
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+// setFlags parses args into a command line of its own for the rest of the
+// test, so flags set by one test don't count as set in the next.
+func setFlags(t *testing.T, args ...string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	commandLine := flag.CommandLine
+	flag.CommandLine = fs
+	t.Cleanup(func() { flag.CommandLine = commandLine })
+}
+
+func TestApplyFlags(t *testing.T) {
+	setFlags(t, "-listen", ":10710", "-upstream-read-timeout", "7s")
+
+	c := DefaultConfig()
+
+	if err := applyFlags(c); err != nil {
+		t.Fatalf("applyFlags failed with %v", err)
+	}
+
+	if p := c.Proxies[0]; p.Listen != ":10710" || p.Upstream.Timeouts.Read != Duration(7*time.Second) {
+		t.Errorf("Expected the flags to override the config, got %s and %v", p.Listen, p.Upstream.Timeouts.Read)
+	}
+}
+
+func TestApplyFlagsAmbiguous(t *testing.T) {
+	c := DefaultConfig()
+	c.Proxies = append(c.Proxies, *DefaultProxyConfig())
+
+	setFlags(t, "-upstream-read-timeout", "7s")
+
+	if err := applyFlags(c); err != nil {
+		t.Fatalf("Expected timeout flags to apply to every proxy, got %v", err)
+	}
+
+	for _, p := range c.Proxies {
+		if p.Upstream.Timeouts.Read != Duration(7*time.Second) {
+			t.Errorf("Expected every proxy to get the timeout, got %v", p.Upstream.Timeouts.Read)
+		}
+	}
+
+	setFlags(t, "-listen", ":10710")
+
+	if err := applyFlags(c); err == nil || !strings.Contains(err.Error(), "ambiguous with 2 proxies") {
+		t.Errorf("Expected -listen to be ambiguous, got %v", err)
+	}
+}
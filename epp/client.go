@@ -1,8 +1,10 @@
 package epp
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -11,12 +13,69 @@ import (
 
 type Client struct {
 	conn              *Conn
-	busy              sync.Mutex
+	busy              chan struct{}
 	lastOp            int64
+	commands          int64
+	waiting           int64
+	trIDs             uint64
+	closed            int32
 	keepaliveInterval time.Duration
-	keepaliveTicker   *time.Ticker
+	keepaliveCtx      context.Context
+	keepaliveQuit     chan struct{}
+	keepaliveOnce     sync.Once
+	done              chan struct{}
+	doneOnce          sync.Once
 	greeting          *Frame
 	loginResponse     *Frame
+	loginFrame        *Frame
+	connOptions       []ConnOption
+	keepaliveHook     func(error)
+	log               *slog.Logger
+	connecting        sync.Mutex
+	loggingIn         sync.Mutex
+
+	// Pipelined sessions only. Commands are written under writing and wait
+	// in pending, in the order they were sent, for the reader to match them
+	// with a response.
+	slots   chan struct{}
+	writing sync.Mutex
+	mu      sync.Mutex
+	pending []*pendingResponse
+	reading bool
+	err     error
+}
+
+// ErrNotConnected is returned when a pipelined command is sent before the
+// greeting has been read.
+var ErrNotConnected = errors.New("epp: not connected")
+
+// ErrLogoutTimeout is returned by Shutdown when the registry doesn't answer
+// the logout in time.
+var ErrLogoutTimeout = errors.New("epp: timed out waiting for logout")
+
+// LoginError is returned by LoginWithFrame when the registry refuses the
+// login. The session itself is still usable.
+type LoginError struct {
+	Result   Result
+	Response *Frame
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login failed; code=%d, msg=%s", e.Result.Code, e.Result.Msg)
+}
+
+// pendingResponse is a pipelined command waiting for its response. clTRID is
+// the one it was sent with and original the one it came with.
+type pendingResponse struct {
+	clTRID   string
+	original string
+	sent     time.Time
+	done     chan pipelineResult
+}
+
+type pipelineResult struct {
+	frame *Frame
+	err   error
 }
 
 type ClientOption func(*Client)
@@ -27,32 +86,88 @@ func KeepaliveInterval(d time.Duration) ClientOption {
 	}
 }
 
+// KeepaliveHook is called with the result of every keepalive hello.
+func KeepaliveHook(f func(error)) ClientOption {
+	return func(c *Client) {
+		c.keepaliveHook = f
+	}
+}
+
+// Logger is where the session logs keepalives and frames it can't match to
+// a command. It defaults to slog's default logger.
+func Logger(l *slog.Logger) ClientOption {
+	return func(c *Client) {
+		c.log = l
+	}
+}
+
+// KeepaliveContext stops the keepalive when ctx is done. The session itself
+// stays open.
+func KeepaliveContext(ctx context.Context) ClientOption {
+	return func(c *Client) {
+		c.keepaliveCtx = ctx
+	}
+}
+
+// ConnOptions configures the upstream Conn, e.g. its read, write and idle
+// timeouts.
+func ConnOptions(options ...ConnOption) ClientOption {
+	return func(c *Client) {
+		c.connOptions = append(c.connOptions, options...)
+	}
+}
+
+// Pipeline lets up to depth commands be outstanding on the session at once so
+// several goroutines can share it. Since they may choose the same clTRIDs,
+// each command is sent with a clTRID unique to the session and its own is put
+// back in the response. Responses are matched to commands by that clTRID,
+// falling back to the order the commands were sent in. A depth of 1 shares
+// the session but sends one command at a time.
+func Pipeline(depth int) ClientOption {
+	return func(c *Client) {
+		if depth > 0 {
+			c.slots = make(chan struct{}, depth)
+		}
+	}
+}
+
 func NewClient(c net.Conn, options ...ClientOption) *Client {
 	client := Client{
-		conn:              NewConn(c),
 		keepaliveInterval: 5 * time.Minute,
+		keepaliveCtx:      context.Background(),
+		log:               slog.Default(),
+		keepaliveQuit:     make(chan struct{}),
+		done:              make(chan struct{}),
+		busy:              make(chan struct{}, 1),
 	}
 
 	for _, opt := range options {
 		opt(&client)
 	}
 
+	client.conn = NewConn(c, client.connOptions...)
+
 	client.keepaliveStart()
 
 	return &client
 }
 
+// NetConn returns the connection the session runs over.
+func (c *Client) NetConn() net.Conn {
+	return c.conn.Conn
+}
+
 func (c *Client) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
-func (c *Client) readFrame() (*Frame, error) {
-	return c.conn.ReadFrame()
+func (c *Client) readFrame(ctx context.Context) (*Frame, error) {
+	return c.conn.ReadFrameContext(ctx)
 }
 
-func (c *Client) writeFrame(f *Frame) error {
+func (c *Client) writeFrame(ctx context.Context, f *Frame) error {
 	atomic.StoreInt64(&c.lastOp, time.Now().UnixNano())
-	return c.conn.WriteFrame(f)
+	return c.conn.WriteFrameContext(ctx, f)
 }
 
 func (c *Client) keepaliveStart() {
@@ -60,69 +175,368 @@ func (c *Client) keepaliveStart() {
 		return
 	}
 
-	ticker := time.NewTicker(c.keepaliveInterval)
-	go func() {
-		for t := range ticker.C {
+	go c.keepalive(time.NewTicker(c.keepaliveInterval))
+}
+
+// keepalive sends a hello whenever the session has been quiet for the
+// keepalive interval. It returns when the keepalive is stopped, the session
+// is closed or its context is done. A failed hello breaks the session, so
+// that whoever holds it sees Err and Done, and also ends the loop.
+func (c *Client) keepalive(ticker *time.Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.keepaliveQuit:
+			return
+		case <-c.done:
+			return
+		case <-c.keepaliveCtx.Done():
+			return
+		case t := <-ticker.C:
 			lastOp := time.Unix(0, atomic.LoadInt64(&c.lastOp))
-			if t.After(lastOp.Add(c.keepaliveInterval)) {
-				log.Printf("sending keepalive; addr=%v, lastOp=%s", c.conn.RemoteAddr(), lastOp.Format(time.RFC3339))
-				c.Hello()
+			if !t.After(lastOp.Add(c.keepaliveInterval)) {
+				continue
 			}
-		}
-	}()
 
-	c.keepaliveTicker = ticker
+			c.log.Debug("sending keepalive", "upstream", c.conn.RemoteAddr().String(), "last_op", lastOp.Format(time.RFC3339))
+			_, err := c.Hello()
+			if c.keepaliveHook != nil {
+				c.keepaliveHook(err)
+			}
+
+			if err == ErrNotConnected {
+				continue
+			}
+
+			if err != nil {
+				// A hello cut short by Close is not a failure.
+				if atomic.LoadInt32(&c.closed) == 0 {
+					c.log.Warn("keepalive failed, closing session", "upstream", c.conn.RemoteAddr().String(), "err", err)
+					c.fail(err)
+				}
+				return
+			}
+		}
+	}
 }
 
 func (c *Client) keepaliveStop() {
-	if c.keepaliveTicker == nil {
-		return
+	c.keepaliveOnce.Do(func() { close(c.keepaliveQuit) })
+}
+
+// Done is closed when the session is closed or breaks. Err tells the two
+// apart.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// Close stops the keepalive and closes the connection without logging out.
+// Commands still waiting on a pipelined session fail.
+func (c *Client) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	c.keepaliveStop()
+	c.closeDone()
+	return c.conn.Close()
+}
+
+// Pending is the number of commands waiting for a response, including those
+// waiting for their turn to be sent.
+func (c *Client) Pending() int {
+	if c.slots == nil {
+		return int(atomic.LoadInt64(&c.waiting))
 	}
 
-	c.keepaliveTicker.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+// Err returns the error that broke the session, or nil while it is usable.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
 }
 
 func (c *Client) Connect() (*Frame, error) {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext reads the greeting, giving up when ctx is done. A greeting
+// cut short by ctx breaks the session.
+func (c *Client) ConnectContext(ctx context.Context) (*Frame, error) {
+	c.connecting.Lock()
+	defer c.connecting.Unlock()
+
 	if c.greeting != nil {
 		return c.greeting, nil
 	}
 
-	frame, err := c.readFrame()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	frame, err := c.readFrame(ctx)
 
 	if err != nil {
+		if ctx.Err() != nil {
+			c.fail(err)
+		}
 		return nil, err
 	}
 
 	c.greeting = frame
 
+	if c.slots != nil {
+		c.mu.Lock()
+		c.reading = true
+		c.mu.Unlock()
+
+		go c.readResponses()
+	}
+
 	return frame, nil
 }
 
+// Greeting returns what the registry offered in its greeting, or
+// ErrNotConnected if the greeting hasn't been read.
+func (c *Client) Greeting() (*Greeting, error) {
+	c.connecting.Lock()
+	frame := c.greeting
+	c.connecting.Unlock()
+
+	if frame == nil {
+		return nil, ErrNotConnected
+	}
+
+	return frame.DecodeGreeting()
+}
+
 func (c *Client) GetResponse(f *Frame) (*Frame, error) {
-	c.busy.Lock()
-	defer c.busy.Unlock()
+	return c.GetResponseContext(context.Background(), f)
+}
+
+// GetResponseContext sends f and waits for its response until ctx is done.
+// Giving up before f is sent leaves the session as it was. After that a
+// pipelined session stays usable and drops the response when it comes, but
+// any other session is broken since its next response would be this one.
+func (c *Client) GetResponseContext(ctx context.Context, f *Frame) (*Frame, error) {
+	if f.GetCommand() != "" {
+		atomic.AddInt64(&c.commands, 1)
+	}
+
+	if c.slots != nil {
+		return c.pipelined(ctx, f)
+	}
+
+	atomic.AddInt64(&c.waiting, 1)
+	defer atomic.AddInt64(&c.waiting, -1)
+
+	select {
+	case c.busy <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.busy }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	err := c.writeFrame(f)
+	err := c.writeFrame(ctx, f)
 
 	if err != nil {
+		c.fail(err)
 		return nil, err
 	}
 
-	response, err := c.readFrame()
+	response, err := c.readFrame(ctx)
 
 	if err != nil {
+		c.fail(err)
 		return nil, err
 	}
 
 	return response, nil
 }
 
+// pipelined sends f as soon as a slot is free and waits for the reader to
+// hand back its response.
+func (c *Client) pipelined(ctx context.Context, f *Frame) (*Frame, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p := &pendingResponse{
+		sent: time.Now(),
+		done: make(chan pipelineResult, 1),
+	}
+
+	if original := f.GetClTRID(); original != "" {
+		p.clTRID = fmt.Sprintf("%spipe-%d", SvTRIDPrefix, atomic.AddUint64(&c.trIDs, 1))
+		p.original = original
+		f = f.WithClTRID(p.clTRID)
+	}
+
+	c.writing.Lock()
+
+	err := ctx.Err()
+	if err == nil {
+		err = c.enqueue(p)
+	}
+
+	if err != nil {
+		c.writing.Unlock()
+		<-c.slots
+		return nil, err
+	}
+
+	err = c.writeFrame(ctx, f)
+	c.writing.Unlock()
+
+	if err != nil {
+		// Part of the frame may have gone out so nothing after it can be
+		// trusted.
+		c.fail(err)
+	}
+
+	select {
+	case r := <-p.done:
+		<-c.slots
+		return r.frame, r.err
+	case <-ctx.Done():
+		// The response is still owed, so the slot stays taken until the
+		// reader has delivered it to no one.
+		go func() {
+			<-p.done
+			<-c.slots
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) enqueue(p *pendingResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	if !c.reading {
+		return ErrNotConnected
+	}
+
+	c.pending = append(c.pending, p)
+
+	return nil
+}
+
+// readResponses delivers frames from the registry to pending commands until
+// the session fails.
+func (c *Client) readResponses() {
+	for {
+		frame, err := c.readFrame(context.Background())
+
+		if err != nil {
+			// The read deadline was armed when the reader started waiting,
+			// which may have been long before anything was sent. That only
+			// holds while nothing of the next frame has arrived; a frame cut
+			// off partway can't be picked up again.
+			if tErr, ok := err.(*TimeoutError); ok && !tErr.Partial && !c.overdue() {
+				continue
+			}
+
+			c.fail(err)
+			return
+		}
+
+		c.deliver(frame)
+	}
+}
+
+// deliver hands a response to the command sent with the same clTRID, with the
+// command's own clTRID put back, or as it is to the oldest command if there is
+// no match. Registries answer in order, so the clTRID only matters when one
+// does not.
+func (c *Client) deliver(frame *Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		c.log.Warn("dropping unexpected frame", "upstream", c.conn.RemoteAddr().String())
+		return
+	}
+
+	i := 0
+	if clTRID := frame.GetClTRID(); clTRID != "" {
+		for j, p := range c.pending {
+			if p.clTRID == clTRID {
+				i = j
+				frame = frame.WithClTRID(p.original)
+				break
+			}
+		}
+	}
+
+	p := c.pending[i]
+	c.pending = append(c.pending[:i], c.pending[i+1:]...)
+
+	p.done <- pipelineResult{frame: frame}
+}
+
+// overdue reports whether the oldest pending command has waited longer than
+// the connection's idle timeout.
+func (c *Client) overdue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending) > 0 && time.Since(c.pending[0].sent) >= c.conn.headerTimeout()
+}
+
+// fail breaks the session and closes its connection. On a pipelined session
+// every pending command gets err, as does every later one.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+		c.closeDone()
+	}
+
+	for _, p := range c.pending {
+		p.done <- pipelineResult{err: err}
+	}
+
+	c.pending = nil
+}
+
 func (c *Client) LoginWithFrame(frame *Frame) (*Frame, error) {
+	return c.LoginWithFrameContext(context.Background(), frame)
+}
+
+// LoginWithFrameContext is LoginWithFrame giving up when ctx is done, as
+// GetResponseContext does.
+func (c *Client) LoginWithFrameContext(ctx context.Context, frame *Frame) (*Frame, error) {
+	c.loggingIn.Lock()
+	defer c.loggingIn.Unlock()
+
 	if c.loginResponse != nil {
 		return c.loginResponse, nil
 	}
 
-	response, err := c.GetResponse(frame)
+	response, err := c.GetResponseContext(ctx, frame)
 
 	if err != nil {
 		return nil, err
@@ -133,32 +547,88 @@ func (c *Client) LoginWithFrame(frame *Frame) (*Frame, error) {
 		if err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("login failed; %v", result.Msg)
+		return nil, &LoginError{Result: *result, Response: response}
 	}
 
 	c.loginResponse = response
+	c.loginFrame = frame
 
 	return response, nil
 }
 
+// Fresh reports whether no command has been sent on the session yet. Hellos
+// don't count.
+func (c *Client) Fresh() bool {
+	return atomic.LoadInt64(&c.commands) == 0
+}
+
+// LoggedIn reports whether a login has succeeded on the session.
+func (c *Client) LoggedIn() bool {
+	c.loggingIn.Lock()
+	defer c.loggingIn.Unlock()
+
+	return c.loginResponse != nil
+}
+
+// LoginFrame returns the login that succeeded on the session so another
+// session can be logged in the same way, or nil if there hasn't been one.
+func (c *Client) LoginFrame() *Frame {
+	c.loggingIn.Lock()
+	defer c.loggingIn.Unlock()
+
+	return c.loginFrame
+}
+
 func (c *Client) Hello() (*Frame, error) {
 	return c.GetResponse(MakeHelloFrame())
 }
 
-//func (c *Client) Login(clID, password, newPassword, clTRID string, svcs, exts []string) (*Frame, error) {
-//	if c.loginResponse != nil {
-//		return c.loginResponse, nil
-//	}
-//
-//	return c.LoginWithFrame(MakeLoginFrame(clID, password, newPassword, clTRID, svcs, exts))
-//}
+// Login logs in with a login made by MakeLoginFrame. Like LoginWithFrame it
+// returns the earlier response if the session is already logged in.
+func (c *Client) Login(clID, password, newPassword, clTRID string, svcs, exts []string) (*Frame, error) {
+	return c.LoginWithFrame(MakeLoginFrame(clID, password, newPassword, clTRID, svcs, exts))
+}
 
 func (c *Client) Logout() error {
+	return c.LogoutContext(context.Background())
+}
+
+// LogoutContext is Logout giving up when ctx is done, as GetResponseContext
+// does.
+func (c *Client) LogoutContext(ctx context.Context) error {
 	c.keepaliveStop()
 
-	if _, err := c.GetResponse(MakeLogoutFrame()); err != nil {
+	if _, err := c.GetResponseContext(ctx, MakeLogoutFrame()); err != nil {
 		return err
 	}
 
+	c.loggingIn.Lock()
+	c.loginResponse = nil
+	c.loggingIn.Unlock()
+
 	return nil
 }
+
+// Shutdown logs a logged in session out, waiting at most timeout for the
+// registry to answer, and then closes it. A broken session, or any session
+// when timeout is zero, is just closed.
+func (c *Client) Shutdown(timeout time.Duration) error {
+	var err error
+
+	if timeout > 0 && c.LoggedIn() && c.Err() == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = c.LogoutContext(ctx)
+		cancel()
+
+		if err == context.DeadlineExceeded {
+			err = ErrLogoutTimeout
+		}
+	}
+
+	// A broken session has already been closed.
+	if cErr := c.Close(); err == nil && c.Err() == nil {
+		err = cErr
+	}
+
+	return err
+}
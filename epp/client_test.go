@@ -0,0 +1,448 @@
+package epp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeCommand(clTRID string) *Frame {
+	return FrameFromString(strings.Replace(xml_command_info, "ABC-12345", clTRID, 1))
+}
+
+func makeResponse(clTRID string) *Frame {
+	return FrameFromString(strings.Replace(xml_response_success, "ABC-12345", clTRID, 1))
+}
+
+// pipelinedPair returns a connected pipelined client and the registry's end
+// of its connection.
+func pipelinedPair(t *testing.T, depth int) (*Client, *Conn) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+
+	go registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+
+	c := NewClient(client, KeepaliveInterval(0), Pipeline(depth))
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, registry
+}
+
+func TestPipelinedResponsesMatchedByClTRID(t *testing.T) {
+	c, registry := pipelinedPair(t, 2)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for _, clTRID := range []string{"A", "B"} {
+		wg.Add(1)
+		go func(clTRID string) {
+			defer wg.Done()
+
+			response, err := c.GetResponse(makeCommand(clTRID))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if response.GetClTRID() != clTRID {
+				t.Errorf("Expected response for %s, got %s", clTRID, response.GetClTRID())
+			}
+		}(clTRID)
+	}
+
+	var sent []string
+	for i := 0; i < 2; i++ {
+		f, err := registry.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, f.GetClTRID())
+	}
+
+	// Answer out of order.
+	registry.WriteFrame(makeResponse(sent[1]))
+	registry.WriteFrame(makeResponse(sent[0]))
+
+	wg.Wait()
+}
+
+func TestPipelinedDuplicateClTRIDs(t *testing.T) {
+	c, registry := pipelinedPair(t, 2)
+	defer c.Close()
+
+	// Two downstream clients happen to use the same clTRID for different
+	// objects.
+	var wg sync.WaitGroup
+	for _, name := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			cmd := FrameFromString(strings.Replace(string(makeCommand("ABC-1").Raw), "example", name, 1))
+
+			response, err := c.GetResponse(cmd)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if response.GetSvTRID() != name || response.GetClTRID() != "ABC-1" {
+				t.Errorf("Expected the response for %s with clTRID ABC-1, got %s with %s", name, response.GetSvTRID(), response.GetClTRID())
+			}
+		}(name)
+	}
+
+	// The registry sees a different clTRID for each and answers out of order.
+	names := make(map[string]string)
+	var sent []string
+	for i := 0; i < 2; i++ {
+		f, err := registry.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names[f.GetClTRID()] = f.GetObjectNames()[0]
+		sent = append(sent, f.GetClTRID())
+	}
+
+	if sent[0] == sent[1] {
+		t.Fatalf("Expected the commands to be sent with different clTRIDs, got %s twice", sent[0])
+	}
+
+	for _, clTRID := range []string{sent[1], sent[0]} {
+		registry.WriteFrame(FrameFromString(strings.Replace(string(makeResponse(clTRID).Raw), "54321-XYZ", names[clTRID], 1)))
+	}
+
+	wg.Wait()
+}
+
+func TestPipelinedResponsesWithoutClTRIDInOrder(t *testing.T) {
+	c, registry := pipelinedPair(t, 1)
+	defer c.Close()
+
+	go func() {
+		registry.ReadFrame()
+		registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+	}()
+
+	response, err := c.Hello()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(response.Raw), "greeting") {
+		t.Errorf("Expected greeting, got %s", response.Raw)
+	}
+}
+
+func TestPipelinedFailureReachesPendingCommands(t *testing.T) {
+	c, registry := pipelinedPair(t, 2)
+
+	go func() {
+		registry.ReadFrame()
+		registry.Close()
+	}()
+
+	if _, err := c.GetResponse(makeCommand("A")); err == nil {
+		t.Error("Expected error")
+	}
+
+	if c.Err() == nil {
+		t.Error("Expected the session to be broken")
+	}
+
+	if _, err := c.GetResponse(makeCommand("B")); err == nil {
+		t.Error("Expected later commands to fail")
+	}
+}
+
+func TestPipelinedIdleIsNotTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+	defer registry.Close()
+
+	go registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+
+	c := NewClient(client, KeepaliveInterval(0), Pipeline(1), ConnOptions(IdleTimeout(10*time.Millisecond)))
+	defer c.Close()
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := c.Err(); err != nil {
+		t.Errorf("Expected idle session to stay usable, got %v", err)
+	}
+}
+
+func TestPipelinedPartialFrameTimeoutBreaksSession(t *testing.T) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+	defer registry.Close()
+
+	go registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+
+	c := NewClient(client, KeepaliveInterval(0), Pipeline(1), ConnOptions(IdleTimeout(10*time.Millisecond)))
+	defer c.Close()
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Half a header, then nothing.
+	go server.Write([]byte{0, 0})
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err, ok := c.Err().(*TimeoutError); !ok || !err.Partial {
+		t.Errorf("Expected a partial frame to break the session, got %v", c.Err())
+	}
+}
+
+func TestPipelinedCommandBeforeConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewClient(client, KeepaliveInterval(0), Pipeline(1))
+	defer c.Close()
+
+	if _, err := c.Hello(); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestFreshIgnoresHello(t *testing.T) {
+	c, registry := pipelinedPair(t, 1)
+	defer c.Close()
+
+	go func() {
+		for {
+			f, err := registry.ReadFrame()
+			if err != nil {
+				return
+			}
+			registry.WriteFrame(makeResponse(f.GetClTRID()))
+		}
+	}()
+
+	c.Hello()
+
+	if !c.Fresh() {
+		t.Error("Expected session to be fresh after a hello")
+	}
+
+	c.GetResponse(makeCommand("A"))
+
+	if c.Fresh() {
+		t.Error("Expected session not to be fresh after a command")
+	}
+}
+
+func TestShutdownLogsOut(t *testing.T) {
+	c, registry := pipelinedPair(t, 1)
+
+	commands := make(chan string, 2)
+	go func() {
+		for {
+			f, err := registry.ReadFrame()
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- f.GetCommand()
+			registry.WriteFrame(makeResponse(f.GetClTRID()))
+		}
+	}()
+
+	if _, err := c.LoginWithFrame(FrameFromString(xml_command_login)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Shutdown(time.Second); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if c.LoggedIn() {
+		t.Error("Expected session to be logged out")
+	}
+
+	var sent []string
+	for command := range commands {
+		sent = append(sent, command)
+	}
+
+	if strings.Join(sent, ",") != "login,logout" {
+		t.Errorf("Expected login then logout, got %v", sent)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	c, registry := pipelinedPair(t, 1)
+
+	go func() {
+		f, _ := registry.ReadFrame()
+		registry.WriteFrame(makeResponse(f.GetClTRID()))
+
+		// Never answer the logout.
+		registry.ReadFrame()
+	}()
+
+	if _, err := c.LoginWithFrame(FrameFromString(xml_command_login)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Shutdown(10 * time.Millisecond); err != ErrLogoutTimeout {
+		t.Errorf("Expected ErrLogoutTimeout, got %v", err)
+	}
+}
+
+func TestKeepaliveFailureBreaksSession(t *testing.T) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+
+	go func() {
+		registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+		registry.ReadFrame()
+		registry.Close()
+	}()
+
+	var hookErr error
+	hooked := make(chan struct{})
+
+	c := NewClient(client, KeepaliveInterval(10*time.Millisecond), KeepaliveHook(func(err error) {
+		hookErr = err
+		close(hooked)
+	}))
+	defer c.Close()
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to break")
+	}
+
+	<-hooked
+
+	if hookErr == nil || c.Err() == nil {
+		t.Errorf("Expected keepalive failure, got hook=%v, err=%v", hookErr, c.Err())
+	}
+}
+
+func TestKeepaliveStopsWithContext(t *testing.T) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+	defer registry.Close()
+
+	var hellos int32
+
+	go func() {
+		registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+		for {
+			if _, err := registry.ReadFrame(); err != nil {
+				return
+			}
+			atomic.AddInt32(&hellos, 1)
+			registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := NewClient(client, KeepaliveInterval(5*time.Millisecond), KeepaliveContext(ctx))
+	defer c.Close()
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&hellos) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	sent := atomic.LoadInt32(&hellos)
+	time.Sleep(30 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&hellos); n != sent {
+		t.Errorf("Expected no keepalives after cancel, got %d more", n-sent)
+	}
+
+	if c.Err() != nil {
+		t.Errorf("Expected the session to stay open, got %v", c.Err())
+	}
+}
+
+func TestPipelinedCancelKeepsSession(t *testing.T) {
+	c, registry := pipelinedPair(t, 1)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		f, _ := registry.ReadFrame()
+		cancel()
+
+		// Answer the abandoned command late, then the next one.
+		time.Sleep(10 * time.Millisecond)
+		registry.WriteFrame(makeResponse(f.GetClTRID()))
+
+		f, _ = registry.ReadFrame()
+		registry.WriteFrame(makeResponse(f.GetClTRID()))
+	}()
+
+	if _, err := c.GetResponseContext(ctx, makeCommand("A")); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	response, err := c.GetResponse(makeCommand("B"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if response.GetClTRID() != "B" {
+		t.Errorf("Expected response for B, got %s", response.GetClTRID())
+	}
+}
+
+func TestCancelBreaksUnpipelinedSession(t *testing.T) {
+	client, server := net.Pipe()
+	registry := NewConn(server)
+	defer registry.Close()
+
+	go func() {
+		registry.WriteFrame(FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`))
+		registry.ReadFrame()
+	}()
+
+	c := NewClient(client, KeepaliveInterval(0))
+	defer c.Close()
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.GetResponseContext(ctx, makeCommand("A")); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if c.Err() == nil {
+		t.Error("Expected the session to be broken")
+	}
+}
@@ -0,0 +1,383 @@
+package epp
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Message is an EPP document sent by a client: a hello or a command.
+type Message struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:epp-1.0 epp"`
+	Hello   *Hello   `xml:"hello"`
+	Command *Command `xml:"command"`
+}
+
+type Hello struct{}
+
+// Command is an EPP command (RFC 5730). Only the field of the command sent is
+// set.
+type Command struct {
+	Login    *Login    `xml:"login"`
+	Logout   *Logout   `xml:"logout"`
+	Poll     *Poll     `xml:"poll"`
+	Check    *Check    `xml:"check"`
+	Info     *Info     `xml:"info"`
+	Create   *Create   `xml:"create"`
+	Update   *Update   `xml:"update"`
+	Delete   *Delete   `xml:"delete"`
+	Renew    *Renew    `xml:"renew"`
+	Transfer *Transfer `xml:"transfer"`
+
+	Extension *Extension `xml:"extension"`
+	ClTRID    string     `xml:"clTRID,omitempty"`
+}
+
+// Extension holds a command's extension elements as they were sent.
+type Extension struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type Login struct {
+	ClID    string       `xml:"clID"`
+	Pw      string       `xml:"pw"`
+	NewPW   string       `xml:"newPW,omitempty"`
+	Options LoginOptions `xml:"options"`
+	Svcs    LoginSvcs    `xml:"svcs"`
+}
+
+type LoginOptions struct {
+	Version string `xml:"version"`
+	Lang    string `xml:"lang"`
+}
+
+// LoginSvcs are the object and extension namespaces a client will use.
+type LoginSvcs struct {
+	ObjURIs []string `xml:"objURI"`
+	ExtURIs []string `xml:"svcExtension>extURI"`
+}
+
+type svcExtension struct {
+	ExtURIs []string `xml:"extURI"`
+}
+
+// MarshalXML leaves out svcExtension when there are no ExtURIs; it may not
+// be empty.
+func (s LoginSvcs) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		ObjURIs      []string      `xml:"objURI"`
+		SvcExtension *svcExtension `xml:"svcExtension"`
+	}{ObjURIs: s.ObjURIs}
+
+	if len(s.ExtURIs) > 0 {
+		v.SvcExtension = &svcExtension{ExtURIs: s.ExtURIs}
+	}
+
+	return e.EncodeElement(v, start)
+}
+
+type Logout struct{}
+
+// Poll is a poll command. Op is "req" or "ack"; MsgID is the message being
+// acknowledged.
+type Poll struct {
+	Op    string `xml:"op,attr"`
+	MsgID string `xml:"msgID,attr,omitempty"`
+}
+
+// Check, Info, Create, Update, Delete, Renew and Transfer have a field for
+// each object type the command applies to, of which only one is set.
+
+type Check struct {
+	Domain  *DomainCheck  `xml:"urn:ietf:params:xml:ns:domain-1.0 check"`
+	Host    *HostCheck    `xml:"urn:ietf:params:xml:ns:host-1.0 check"`
+	Contact *ContactCheck `xml:"urn:ietf:params:xml:ns:contact-1.0 check"`
+}
+
+type Info struct {
+	Domain  *DomainInfo  `xml:"urn:ietf:params:xml:ns:domain-1.0 info"`
+	Host    *HostInfo    `xml:"urn:ietf:params:xml:ns:host-1.0 info"`
+	Contact *ContactInfo `xml:"urn:ietf:params:xml:ns:contact-1.0 info"`
+}
+
+type Create struct {
+	Domain  *DomainCreate  `xml:"urn:ietf:params:xml:ns:domain-1.0 create"`
+	Host    *HostCreate    `xml:"urn:ietf:params:xml:ns:host-1.0 create"`
+	Contact *ContactCreate `xml:"urn:ietf:params:xml:ns:contact-1.0 create"`
+}
+
+type Update struct {
+	Domain  *DomainUpdate  `xml:"urn:ietf:params:xml:ns:domain-1.0 update"`
+	Host    *HostUpdate    `xml:"urn:ietf:params:xml:ns:host-1.0 update"`
+	Contact *ContactUpdate `xml:"urn:ietf:params:xml:ns:contact-1.0 update"`
+}
+
+type Delete struct {
+	Domain  *DomainDelete  `xml:"urn:ietf:params:xml:ns:domain-1.0 delete"`
+	Host    *HostDelete    `xml:"urn:ietf:params:xml:ns:host-1.0 delete"`
+	Contact *ContactDelete `xml:"urn:ietf:params:xml:ns:contact-1.0 delete"`
+}
+
+type Renew struct {
+	Domain *DomainRenew `xml:"urn:ietf:params:xml:ns:domain-1.0 renew"`
+}
+
+// Transfer is a transfer command. Op is one of "request", "query",
+// "approve", "reject" or "cancel".
+type Transfer struct {
+	Op      string           `xml:"op,attr"`
+	Domain  *DomainTransfer  `xml:"urn:ietf:params:xml:ns:domain-1.0 transfer"`
+	Contact *ContactTransfer `xml:"urn:ietf:params:xml:ns:contact-1.0 transfer"`
+}
+
+// AuthInfo is an object's authorization information. Roid names the contact
+// whose password it is, for a domain transfer authorized by a contact.
+type AuthInfo struct {
+	Pw   string
+	Roid string
+}
+
+type authInfoPw struct {
+	Value string `xml:",chardata"`
+	Roid  string `xml:"roid,attr,omitempty"`
+}
+
+type authInfo struct {
+	Pw authInfoPw `xml:"pw"`
+}
+
+func (a *AuthInfo) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v authInfo
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+
+	*a = AuthInfo{Pw: v.Pw.Value, Roid: v.Pw.Roid}
+
+	return nil
+}
+
+func (a AuthInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(authInfo{Pw: authInfoPw{Value: a.Pw, Roid: a.Roid}}, start)
+}
+
+// Period is a registration period, Unit being "y" for years or "m" for
+// months.
+type Period struct {
+	Value int    `xml:",chardata"`
+	Unit  string `xml:"unit,attr"`
+}
+
+// Status is an object status such as clientHold, with an optional reason.
+type Status struct {
+	S      string `xml:"s,attr"`
+	Lang   string `xml:"lang,attr,omitempty"`
+	Reason string `xml:",chardata"`
+}
+
+type DomainCheck struct {
+	Names []string `xml:"name"`
+}
+
+type DomainInfo struct {
+	Name     DomainInfoName `xml:"name"`
+	AuthInfo *AuthInfo      `xml:"authInfo"`
+}
+
+// DomainInfoName is the domain of an info command. Hosts is "all", "del",
+// "sub" or "none".
+type DomainInfoName struct {
+	Name  string `xml:",chardata"`
+	Hosts string `xml:"hosts,attr,omitempty"`
+}
+
+type DomainCreate struct {
+	Name       string          `xml:"name"`
+	Period     *Period         `xml:"period"`
+	NS         *DomainNS       `xml:"ns"`
+	Registrant string          `xml:"registrant,omitempty"`
+	Contacts   []DomainContact `xml:"contact"`
+	AuthInfo   *AuthInfo       `xml:"authInfo"`
+}
+
+// DomainNS are a domain's name servers, given as host objects or, for
+// registries without them, host attributes.
+type DomainNS struct {
+	HostObjs  []string       `xml:"hostObj"`
+	HostAttrs []DomainHostAt `xml:"hostAttr"`
+}
+
+type DomainHostAt struct {
+	HostName  string     `xml:"hostName"`
+	HostAddrs []HostAddr `xml:"hostAddr"`
+}
+
+// DomainContact is a contact linked to a domain, Type being "admin",
+// "billing" or "tech".
+type DomainContact struct {
+	ID   string `xml:",chardata"`
+	Type string `xml:"type,attr"`
+}
+
+type DomainUpdate struct {
+	Name string           `xml:"name"`
+	Add  *DomainAddRem    `xml:"add"`
+	Rem  *DomainAddRem    `xml:"rem"`
+	Chg  *DomainUpdateChg `xml:"chg"`
+}
+
+type DomainAddRem struct {
+	NS       *DomainNS       `xml:"ns"`
+	Contacts []DomainContact `xml:"contact"`
+	Statuses []Status        `xml:"status"`
+}
+
+type DomainUpdateChg struct {
+	Registrant string    `xml:"registrant,omitempty"`
+	AuthInfo   *AuthInfo `xml:"authInfo"`
+}
+
+type DomainDelete struct {
+	Name string `xml:"name"`
+}
+
+type DomainRenew struct {
+	Name       string  `xml:"name"`
+	CurExpDate string  `xml:"curExpDate"`
+	Period     *Period `xml:"period"`
+}
+
+type DomainTransfer struct {
+	Name     string    `xml:"name"`
+	Period   *Period   `xml:"period"`
+	AuthInfo *AuthInfo `xml:"authInfo"`
+}
+
+type HostCheck struct {
+	Names []string `xml:"name"`
+}
+
+type HostInfo struct {
+	Name string `xml:"name"`
+}
+
+// HostAddr is an IP address of a host, IP being "v4" or "v6".
+type HostAddr struct {
+	Addr string `xml:",chardata"`
+	IP   string `xml:"ip,attr,omitempty"`
+}
+
+type HostCreate struct {
+	Name  string     `xml:"name"`
+	Addrs []HostAddr `xml:"addr"`
+}
+
+type HostUpdate struct {
+	Name string         `xml:"name"`
+	Add  *HostAddRem    `xml:"add"`
+	Rem  *HostAddRem    `xml:"rem"`
+	Chg  *HostUpdateChg `xml:"chg"`
+}
+
+type HostAddRem struct {
+	Addrs    []HostAddr `xml:"addr"`
+	Statuses []Status   `xml:"status"`
+}
+
+type HostUpdateChg struct {
+	Name string `xml:"name"`
+}
+
+type HostDelete struct {
+	Name string `xml:"name"`
+}
+
+type ContactCheck struct {
+	IDs []string `xml:"id"`
+}
+
+type ContactInfo struct {
+	ID       string    `xml:"id"`
+	AuthInfo *AuthInfo `xml:"authInfo"`
+}
+
+// PostalInfo is a contact's postal details, Type being "int" for the ASCII
+// form or "loc" for the localized one.
+type PostalInfo struct {
+	Type string        `xml:"type,attr"`
+	Name string        `xml:"name"`
+	Org  string        `xml:"org,omitempty"`
+	Addr PostalAddress `xml:"addr"`
+}
+
+type PostalAddress struct {
+	Streets []string `xml:"street"`
+	City    string   `xml:"city"`
+	SP      string   `xml:"sp,omitempty"`
+	PC      string   `xml:"pc,omitempty"`
+	CC      string   `xml:"cc"`
+}
+
+// Disclose lists contact fields to show, Flag true, or hide, Flag false,
+// against the registry's policy.
+type Disclose struct {
+	Flag   bool            `xml:"flag,attr"`
+	Fields []DiscloseField `xml:",any"`
+}
+
+// DiscloseField is a contact field such as voice, or name with a postal info
+// Type.
+type DiscloseField struct {
+	XMLName xml.Name
+	Type    string `xml:"type,attr,omitempty"`
+}
+
+type ContactCreate struct {
+	ID         string       `xml:"id"`
+	PostalInfo []PostalInfo `xml:"postalInfo"`
+	Voice      string       `xml:"voice,omitempty"`
+	Fax        string       `xml:"fax,omitempty"`
+	Email      string       `xml:"email"`
+	AuthInfo   *AuthInfo    `xml:"authInfo"`
+	Disclose   *Disclose    `xml:"disclose"`
+}
+
+type ContactUpdate struct {
+	ID  string            `xml:"id"`
+	Add *ContactAddRem    `xml:"add"`
+	Rem *ContactAddRem    `xml:"rem"`
+	Chg *ContactUpdateChg `xml:"chg"`
+}
+
+type ContactAddRem struct {
+	Statuses []Status `xml:"status"`
+}
+
+type ContactUpdateChg struct {
+	PostalInfo []PostalInfo `xml:"postalInfo"`
+	Voice      string       `xml:"voice,omitempty"`
+	Fax        string       `xml:"fax,omitempty"`
+	Email      string       `xml:"email,omitempty"`
+	AuthInfo   *AuthInfo    `xml:"authInfo"`
+	Disclose   *Disclose    `xml:"disclose"`
+}
+
+type ContactDelete struct {
+	ID string `xml:"id"`
+}
+
+type ContactTransfer struct {
+	ID       string    `xml:"id"`
+	AuthInfo *AuthInfo `xml:"authInfo"`
+}
+
+// Decode parses the frame into a Message, so a command's fields can be read
+// without looking them up by name.
+func (f *Frame) Decode() (*Message, error) {
+	var m Message
+
+	if err := xml.Unmarshal(f.Raw, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode frame; %v", err)
+	}
+
+	return &m, nil
+}
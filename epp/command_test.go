@@ -0,0 +1,373 @@
+package epp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeLogin(t *testing.T) {
+	m, err := FrameFromString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<epp xmlns="urn:ietf:params:xml:ns:epp-1.0">
+  <command>
+    <login>
+      <clID>ClientX</clID>
+      <pw>foo-BAR2</pw>
+      <newPW>bar-FOO2</newPW>
+      <options><version>1.0</version><lang>en</lang></options>
+      <svcs>
+        <objURI>urn:ietf:params:xml:ns:obj1</objURI>
+        <objURI>urn:ietf:params:xml:ns:obj2</objURI>
+        <svcExtension><extURI>http://custom/obj1ext-1.0</extURI></svcExtension>
+      </svcs>
+    </login>
+    <clTRID>ABC-12345</clTRID>
+  </command>
+</epp>`).Decode()
+
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	if m.Command == nil || m.Command.Login == nil {
+		t.Fatalf("Expected a login command, got %+v", m)
+	}
+
+	login := m.Command.Login
+
+	if login.ClID != "ClientX" || login.Pw != "foo-BAR2" || login.NewPW != "bar-FOO2" {
+		t.Errorf("Unexpected credentials %+v", login)
+	}
+
+	if login.Options.Version != "1.0" || login.Options.Lang != "en" {
+		t.Errorf("Unexpected options %+v", login.Options)
+	}
+
+	if len(login.Svcs.ObjURIs) != 2 || len(login.Svcs.ExtURIs) != 1 || login.Svcs.ExtURIs[0] != "http://custom/obj1ext-1.0" {
+		t.Errorf("Unexpected svcs %+v", login.Svcs)
+	}
+
+	if m.Command.ClTRID != "ABC-12345" {
+		t.Errorf("Expected 'ABC-12345', got '%v'", m.Command.ClTRID)
+	}
+}
+
+func TestDecodeHello(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><hello/></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	if m.Hello == nil || m.Command != nil {
+		t.Errorf("Expected a hello, got %+v", m)
+	}
+}
+
+func TestDecodePoll(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><poll op="ack" msgID="12345"/><clTRID>ABC-12346</clTRID></command></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	if p := m.Command.Poll; p == nil || p.Op != "ack" || p.MsgID != "12345" {
+		t.Errorf("Unexpected poll %+v", m.Command.Poll)
+	}
+}
+
+func TestDecodeObjectTypes(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check>` +
+		`<host:check xmlns:host="urn:ietf:params:xml:ns:host-1.0"><host:name>ns1.example.com</host:name><host:name>ns2.example.com</host:name></host:check>` +
+		`</check></command></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	check := m.Command.Check
+
+	if check.Domain != nil || check.Contact != nil {
+		t.Errorf("Expected only a host check, got %+v", check)
+	}
+
+	if check.Host == nil || len(check.Host.Names) != 2 || check.Host.Names[1] != "ns2.example.com" {
+		t.Errorf("Unexpected host check %+v", check.Host)
+	}
+}
+
+func TestDecodeDomainCreate(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create>
+<domain:create xmlns:domain="urn:ietf:params:xml:ns:domain-1.0">
+  <domain:name>example.com</domain:name>
+  <domain:period unit="y">2</domain:period>
+  <domain:ns><domain:hostObj>ns1.example.net</domain:hostObj><domain:hostObj>ns2.example.net</domain:hostObj></domain:ns>
+  <domain:registrant>jd1234</domain:registrant>
+  <domain:contact type="admin">sh8013</domain:contact>
+  <domain:contact type="tech">sh8014</domain:contact>
+  <domain:authInfo><domain:pw>2fooBAR</domain:pw></domain:authInfo>
+</domain:create></create>
+<extension><secDNS:create xmlns:secDNS="urn:ietf:params:xml:ns:secDNS-1.1"/></extension>
+<clTRID>ABC-12345</clTRID></command></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	d := m.Command.Create.Domain
+	if d == nil {
+		t.Fatalf("Expected a domain create, got %+v", m.Command.Create)
+	}
+
+	if d.Name != "example.com" || d.Registrant != "jd1234" {
+		t.Errorf("Unexpected domain create %+v", d)
+	}
+
+	if d.Period == nil || d.Period.Value != 2 || d.Period.Unit != "y" {
+		t.Errorf("Expected a 2y period, got %+v", d.Period)
+	}
+
+	if d.NS == nil || len(d.NS.HostObjs) != 2 {
+		t.Errorf("Expected 2 name servers, got %+v", d.NS)
+	}
+
+	if len(d.Contacts) != 2 || d.Contacts[1].Type != "tech" || d.Contacts[1].ID != "sh8014" {
+		t.Errorf("Unexpected contacts %+v", d.Contacts)
+	}
+
+	if d.AuthInfo == nil || d.AuthInfo.Pw != "2fooBAR" {
+		t.Errorf("Unexpected authInfo %+v", d.AuthInfo)
+	}
+
+	if m.Command.Extension == nil || m.Command.Extension.InnerXML == "" {
+		t.Error("Expected the extension to be kept")
+	}
+}
+
+func TestDecodeDomainTransfer(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><transfer op="request">
+<domain:transfer xmlns:domain="urn:ietf:params:xml:ns:domain-1.0">
+  <domain:name>example.com</domain:name>
+  <domain:period unit="y">1</domain:period>
+  <domain:authInfo><domain:pw roid="JD1234-REP">2fooBAR</domain:pw></domain:authInfo>
+</domain:transfer></transfer><clTRID>ABC-12345</clTRID></command></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	transfer := m.Command.Transfer
+
+	if transfer.Op != "request" || transfer.Domain == nil || transfer.Domain.Name != "example.com" {
+		t.Fatalf("Unexpected transfer %+v", transfer)
+	}
+
+	if a := transfer.Domain.AuthInfo; a == nil || a.Pw != "2fooBAR" || a.Roid != "JD1234-REP" {
+		t.Errorf("Unexpected authInfo %+v", a)
+	}
+}
+
+func TestDecodeContactCreate(t *testing.T) {
+	m, err := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create>
+<contact:create xmlns:contact="urn:ietf:params:xml:ns:contact-1.0">
+  <contact:id>sh8013</contact:id>
+  <contact:postalInfo type="int">
+    <contact:name>John Doe</contact:name>
+    <contact:org>Example Inc.</contact:org>
+    <contact:addr>
+      <contact:street>123 Example Dr.</contact:street>
+      <contact:street>Suite 100</contact:street>
+      <contact:city>Dulles</contact:city>
+      <contact:sp>VA</contact:sp>
+      <contact:pc>20166-6503</contact:pc>
+      <contact:cc>US</contact:cc>
+    </contact:addr>
+  </contact:postalInfo>
+  <contact:voice>+1.7035555555</contact:voice>
+  <contact:email>jdoe@example.com</contact:email>
+  <contact:authInfo><contact:pw>2fooBAR</contact:pw></contact:authInfo>
+  <contact:disclose flag="0"><contact:voice/><contact:email/></contact:disclose>
+</contact:create></create></command></epp>`).Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	c := m.Command.Create.Contact
+	if c == nil {
+		t.Fatalf("Expected a contact create, got %+v", m.Command.Create)
+	}
+
+	if c.ID != "sh8013" || c.Email != "jdoe@example.com" || c.Voice != "+1.7035555555" {
+		t.Errorf("Unexpected contact create %+v", c)
+	}
+
+	if len(c.PostalInfo) != 1 || c.PostalInfo[0].Type != "int" || len(c.PostalInfo[0].Addr.Streets) != 2 || c.PostalInfo[0].Addr.CC != "US" {
+		t.Errorf("Unexpected postal info %+v", c.PostalInfo)
+	}
+
+	if c.Disclose == nil || c.Disclose.Flag || len(c.Disclose.Fields) != 2 || c.Disclose.Fields[1].XMLName.Local != "email" {
+		t.Errorf("Unexpected disclose %+v", c.Disclose)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	f := FrameFromString(`<epp><command>`)
+
+	if _, err := f.Decode(); err == nil {
+		t.Error("Expected an error for malformed XML")
+	}
+
+	if cmd := f.GetCommand(); cmd != "" {
+		t.Errorf("Expected no command, got '%v'", cmd)
+	}
+
+	if _, err := f.GetResult(); err == nil {
+		t.Error("Expected an error getting the result of malformed XML")
+	}
+}
+
+func TestMakeLoginFrame(t *testing.T) {
+	f := MakeLoginFrame("Client<X>", "p&w", "new\"pw", "ABC-1", []string{"urn:ietf:params:xml:ns:domain-1.0"}, []string{"urn:ietf:params:xml:ns:secDNS-1.1"})
+
+	if !strings.HasPrefix(string(f.Raw), `<?xml version="1.0" encoding="UTF-8"?>`+"\n<epp") {
+		t.Errorf("Expected an XML declaration then epp, got %s", f.Raw)
+	}
+
+	if strings.Contains(string(f.Raw), "p&w") || strings.Contains(string(f.Raw), "Client<X>") {
+		t.Errorf("Expected text to be escaped, got %s", f.Raw)
+	}
+
+	if f.GetCommand() != "login" || f.GetClTRID() != "ABC-1" {
+		t.Errorf("Expected a login with clTRID ABC-1, got %s", f.Raw)
+	}
+
+	m, err := f.Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	login := m.Command.Login
+
+	if login.ClID != "Client<X>" || login.Pw != "p&w" || login.NewPW != "new\"pw" {
+		t.Errorf("Unexpected credentials %+v", login)
+	}
+
+	if login.Options.Version != "1.0" || login.Options.Lang != "en" {
+		t.Errorf("Unexpected options %+v", login.Options)
+	}
+
+	if len(login.Svcs.ObjURIs) != 1 || len(login.Svcs.ExtURIs) != 1 {
+		t.Errorf("Unexpected svcs %+v", login.Svcs)
+	}
+}
+
+func TestMakeLoginFrameWithoutExtensions(t *testing.T) {
+	f := MakeLoginFrame("ClientX", "pw", "", "ABC-1", []string{"urn:ietf:params:xml:ns:domain-1.0"}, nil)
+
+	if strings.Contains(string(f.Raw), "newPW") || strings.Contains(string(f.Raw), "svcExtension") {
+		t.Errorf("Expected no newPW or svcExtension, got %s", f.Raw)
+	}
+}
+
+func TestMakeHelloAndLogoutFrames(t *testing.T) {
+	if m, err := MakeHelloFrame().Decode(); err != nil || m.Hello == nil {
+		t.Errorf("Expected a hello, got %+v, %v", m, err)
+	}
+
+	if cmd := MakeLogoutFrame().GetCommand(); cmd != "logout" {
+		t.Errorf("Expected 'logout', got '%v'", cmd)
+	}
+}
+
+func TestMakePollFrame(t *testing.T) {
+	m, err := MakePollFrame("", "ABC-1").Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	if p := m.Command.Poll; p.Op != "req" || p.MsgID != "" {
+		t.Errorf("Expected a poll req, got %+v", p)
+	}
+
+	m, err = MakePollFrame("12345", "ABC-2").Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	if p := m.Command.Poll; p.Op != "ack" || p.MsgID != "12345" {
+		t.Errorf("Expected a poll ack of 12345, got %+v", p)
+	}
+}
+
+func TestMakeCommandFrameDomainCreate(t *testing.T) {
+	f, err := MakeCommandFrame(&Command{
+		Create: &Create{Domain: &DomainCreate{
+			Name:       "example.com",
+			Period:     &Period{Value: 2, Unit: "y"},
+			NS:         &DomainNS{HostObjs: []string{"ns1.example.net"}},
+			Registrant: "jd1234",
+			Contacts:   []DomainContact{{ID: "sh8013", Type: "admin"}},
+			AuthInfo:   &AuthInfo{Pw: "2foo<BAR"},
+		}},
+		ClTRID: "ABC-12345",
+	})
+	if err != nil {
+		t.Fatalf("MakeCommandFrame failed with %v", err)
+	}
+
+	if !strings.Contains(string(f.Raw), `<create xmlns="urn:ietf:params:xml:ns:domain-1.0"><name>example.com</name><period unit="y">2</period>`) {
+		t.Errorf("Unexpected domain create %s", f.Raw)
+	}
+
+	if names := f.GetObjectNames(); len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("Expected [example.com], got %v", names)
+	}
+
+	m, err := f.Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	d := m.Command.Create.Domain
+	if d.AuthInfo.Pw != "2foo<BAR" || d.Contacts[0].Type != "admin" || d.NS.HostObjs[0] != "ns1.example.net" {
+		t.Errorf("Unexpected domain create %+v", d)
+	}
+}
+
+func TestMakeCommandFrameTransfer(t *testing.T) {
+	f, err := MakeCommandFrame(&Command{
+		Transfer: &Transfer{Op: "request", Contact: &ContactTransfer{ID: "sh8013", AuthInfo: &AuthInfo{Pw: "2fooBAR"}}},
+		ClTRID:   "ABC-12345",
+	})
+	if err != nil {
+		t.Fatalf("MakeCommandFrame failed with %v", err)
+	}
+
+	expected := `<transfer op="request"><transfer xmlns="urn:ietf:params:xml:ns:contact-1.0"><id>sh8013</id><authInfo><pw>2fooBAR</pw></authInfo></transfer></transfer>`
+
+	if !strings.Contains(string(f.Raw), expected) {
+		t.Errorf("Expected %s in %s", expected, f.Raw)
+	}
+}
+
+func TestMakeCommandFrameHostUpdate(t *testing.T) {
+	f, err := MakeCommandFrame(&Command{
+		Update: &Update{Host: &HostUpdate{
+			Name: "ns1.example.com",
+			Add:  &HostAddRem{Addrs: []HostAddr{{Addr: "192.0.2.22", IP: "v4"}}, Statuses: []Status{{S: "clientUpdateProhibited"}}},
+			Rem:  &HostAddRem{Addrs: []HostAddr{{Addr: "1080::8:800:200C:417A", IP: "v6"}}},
+			Chg:  &HostUpdateChg{Name: "ns2.example.com"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("MakeCommandFrame failed with %v", err)
+	}
+
+	m, err := f.Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	h := m.Command.Update.Host
+	if h == nil || h.Add.Addrs[0].IP != "v4" || h.Add.Statuses[0].S != "clientUpdateProhibited" || h.Rem.Addrs[0].IP != "v6" || h.Chg.Name != "ns2.example.com" {
+		t.Errorf("Unexpected host update %+v", h)
+	}
+
+	if strings.Contains(string(f.Raw), "clTRID") {
+		t.Errorf("Expected no clTRID, got %s", f.Raw)
+	}
+}
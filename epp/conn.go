@@ -1,50 +1,354 @@
 package epp
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"time"
 )
 
+// headerSize is the length of the RFC 5734 total length prefix, which counts
+// itself.
+const headerSize = 4
+
+// DefaultMaxFrameSize is the largest frame, header included, that a Conn
+// will read or write unless configured otherwise.
+const DefaultMaxFrameSize = 16 << 20
+
+var (
+	// ErrFrameTooLarge is returned when a frame header announces, or a frame
+	// to be written needs, more than the configured maximum size.
+	ErrFrameTooLarge = errors.New("epp: frame too large")
+
+	// ErrShortFrame is returned when a frame header announces a total length
+	// smaller than the header itself.
+	ErrShortFrame = errors.New("epp: frame shorter than header")
+)
+
+// TimeoutError is returned when a frame could not be read or written before
+// its deadline. It lets callers tell a stalled peer apart from a closed one.
+type TimeoutError struct {
+	Op  string
+	Err error
+
+	// Partial is set when a read timed out partway through a frame, which
+	// leaves the connection out of step with its peer.
+	Partial bool
+}
+
+func (e *TimeoutError) Error() string {
+	return "epp: " + e.Op + " timeout: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return true }
+
+// IsTimeout reports whether err is a TimeoutError.
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
 type Conn struct {
 	net.Conn
+	maxFrameSize uint32
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+}
+
+type ConnOption func(*Conn)
+
+// MaxFrameSize limits the total length, header included, of frames read or
+// written on the connection.
+func MaxFrameSize(n uint32) ConnOption {
+	return func(c *Conn) {
+		c.maxFrameSize = n
+	}
+}
+
+// ReadTimeout limits how long reading the body of a frame may take once its
+// header has arrived. Without an IdleTimeout it also bounds the header.
+func ReadTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.readTimeout = d
+	}
+}
+
+// WriteTimeout limits how long writing a whole frame may take.
+func WriteTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.writeTimeout = d
+	}
+}
+
+// IdleTimeout limits how long ReadFrame waits for the next frame to start.
+// On a downstream connection that is the client's think time, on an upstream
+// one it is the registry's processing time.
+func IdleTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.idleTimeout = d
+	}
+}
+
+func NewConn(c net.Conn, options ...ConnOption) *Conn {
+	conn := Conn{
+		Conn:         c,
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+
+	for _, opt := range options {
+		opt(&conn)
+	}
+
+	return &conn
 }
 
-func NewConn(c net.Conn) *Conn {
-	return &Conn{Conn: c}
+// headerTimeout is how long ReadFrame waits for a frame to start.
+func (c *Conn) headerTimeout() time.Duration {
+	if c.idleTimeout > 0 {
+		return c.idleTimeout
+	}
+
+	return c.readTimeout
 }
 
 func (c *Conn) ReadFrame() (*Frame, error) {
-	header := make([]byte, 4)
+	return c.ReadFrameContext(context.Background())
+}
 
-	// TODO: handle partial read
-	if _, err := c.Read(header); err != nil {
+// ReadFrameContext is ReadFrame bounded by ctx as well as the timeouts. It
+// returns ctx's error if ctx is done first. A frame cut short that way
+// leaves the connection out of step with its peer.
+func (c *Conn) ReadFrameContext(ctx context.Context) (*Frame, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	size := binary.BigEndian.Uint32(header) - 4
+	deadline, _ := ctx.Deadline()
 
-	body := make([]byte, size)
+	r := &deadlineReader{
+		conn:     c.Conn,
+		timeout:  c.headerTimeout(),
+		next:     c.readTimeout,
+		ctx:      ctx,
+		deadline: deadline,
+	}
 
-	// TODO: handle partial read
-	if _, err := c.Read(body); err != nil {
+	stop := interrupt(ctx, c.SetReadDeadline)
+	frame, err := readFrame(r, c.maxFrameSize)
+	stop()
+
+	if err := contextErr(ctx, deadline, err); err != nil {
 		return nil, err
 	}
 
-	return &Frame{Size: size, Raw: body}, nil
+	err = c.wrapTimeout("read", err)
+	if tErr, ok := err.(*TimeoutError); ok {
+		tErr.Partial = r.read > 0
+	}
+
+	return frame, err
 }
 
 func (c *Conn) WriteFrame(frame *Frame) error {
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, frame.Size+4)
+	return c.WriteFrameContext(context.Background(), frame)
+}
 
-	// TODO: handle partial write
-	if _, err := c.Write(header); err != nil {
+// WriteFrameContext is WriteFrame bounded by ctx as well as the write
+// timeout. A frame cut short by ctx leaves the connection out of step with
+// its peer.
+func (c *Conn) WriteFrameContext(ctx context.Context, frame *Frame) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if _, err := c.Write(frame.Raw); err != nil {
+	deadline, _ := ctx.Deadline()
+
+	if err := c.SetWriteDeadline(earliest(c.writeTimeout, deadline)); err != nil {
+		return err
+	}
+
+	stop := interrupt(ctx, c.SetWriteDeadline)
+	err := writeFrame(c.Conn, frame, c.maxFrameSize)
+	stop()
+
+	if err := contextErr(ctx, deadline, err); err != nil {
+		return err
+	}
+
+	return c.wrapTimeout("write", err)
+}
+
+// interrupt unblocks a read or write in progress when ctx is done by moving
+// its deadline into the past. The returned func must be called once the
+// read or write is over.
+func interrupt(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	over := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-over:
+		}
+	}()
+
+	return func() {
+		close(over)
+		<-exited
+	}
+}
+
+// earliest is the deadline d from now, or deadline if that comes first.
+// Zero values mean none.
+func earliest(d time.Duration, deadline time.Time) time.Time {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+
+	if !deadline.IsZero() && (t.IsZero() || deadline.Before(t)) {
+		t = deadline
+	}
+
+	return t
+}
+
+// contextErr returns ctx's error if err is down to ctx: either ctx is done, or
+// the socket deadline taken from ctx passed before ctx noticed its own.
+func contextErr(ctx context.Context, deadline time.Time, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+func (c *Conn) wrapTimeout(op string, err error) error {
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+		return &TimeoutError{Op: op, Err: err}
+	}
+
+	return err
+}
+
+// deadlineReader sets a read deadline before the first read of a frame and
+// switches to the next timeout once the header is complete. Neither goes
+// past deadline, nor outlives ctx.
+type deadlineReader struct {
+	conn     net.Conn
+	timeout  time.Duration
+	next     time.Duration
+	ctx      context.Context
+	deadline time.Time
+	read     int
+	armed    bool
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if !r.armed {
+		if err := r.arm(r.timeout); err != nil {
+			return 0, err
+		}
+		r.armed = true
+	}
+
+	n, err := r.conn.Read(p)
+
+	if r.read < headerSize && r.read+n >= headerSize {
+		if err := r.arm(r.next); err != nil {
+			return n, err
+		}
+	}
+	r.read += n
+
+	return n, err
+}
+
+func (r *deadlineReader) arm(d time.Duration) error {
+	if err := r.conn.SetReadDeadline(earliest(d, r.deadline)); err != nil {
 		return err
 	}
 
+	// ctx may have been interrupted just before the deadline was reset.
+	if r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+
+	return nil
+}
+
+func readFrame(r io.Reader, maxFrameSize uint32) (*Frame, error) {
+	header := make([]byte, headerSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	total := binary.BigEndian.Uint32(header)
+
+	if total < headerSize {
+		return nil, ErrShortFrame
+	}
+
+	if total > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	size := total - headerSize
+	body := make([]byte, size)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &Frame{Size: size, Raw: body}, nil
+}
+
+func writeFrame(w io.Writer, frame *Frame, maxFrameSize uint32) error {
+	size := uint64(len(frame.Raw))
+
+	if size+headerSize > uint64(maxFrameSize) {
+		return ErrFrameTooLarge
+	}
+
+	// Send header and body with a single buffer so a frame is never
+	// interleaved with, or split from, its length prefix.
+	buf := make([]byte, headerSize+size)
+	binary.BigEndian.PutUint32(buf, uint32(size+headerSize))
+	copy(buf[headerSize:], frame.Raw)
+
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+
 	return nil
 }
@@ -0,0 +1,252 @@
+package epp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+type oneByteWriter struct {
+	bytes.Buffer
+}
+
+func (w *oneByteWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.Buffer.Write(p[:1])
+}
+
+func makeHeader(total uint32) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, total)
+	return header
+}
+
+func TestReadFrameOneByteAtATime(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(makeHeader(uint32(xml_command_info_len + 4)))
+	buf.WriteString(xml_command_info)
+
+	f, err := readFrame(iotest.OneByteReader(&buf), DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatalf("readFrame failed with %v", err)
+	}
+
+	if string(f.Raw) != xml_command_info {
+		t.Error("Frame.Raw does not match provided xml")
+	}
+
+	if int(f.Size) != xml_command_info_len {
+		t.Errorf("Expected %v, got %v", xml_command_info_len, f.Size)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		max   uint32
+		err   error
+	}{
+		{"empty", nil, DefaultMaxFrameSize, io.EOF},
+		{"partial header", []byte{0, 0}, DefaultMaxFrameSize, io.ErrUnexpectedEOF},
+		{"header below 4", makeHeader(3), DefaultMaxFrameSize, ErrShortFrame},
+		{"header zero", makeHeader(0), DefaultMaxFrameSize, ErrShortFrame},
+		{"header above max", makeHeader(101), 100, ErrFrameTooLarge},
+		{"truncated body", append(makeHeader(10), 'a', 'b'), DefaultMaxFrameSize, io.ErrUnexpectedEOF},
+		{"missing body", makeHeader(10), DefaultMaxFrameSize, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		_, err := readFrame(iotest.OneByteReader(bytes.NewReader(tt.input)), tt.max)
+		if err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestReadFrameEmptyBody(t *testing.T) {
+	f, err := readFrame(bytes.NewReader(makeHeader(4)), DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatalf("readFrame failed with %v", err)
+	}
+
+	if f.Size != 0 || len(f.Raw) != 0 {
+		t.Errorf("Expected empty frame, got size %v", f.Size)
+	}
+}
+
+func TestWriteFrameOneByteAtATime(t *testing.T) {
+	var w oneByteWriter
+
+	if err := writeFrame(&w, FrameFromString(xml_command_info), DefaultMaxFrameSize); err != nil {
+		t.Fatalf("writeFrame failed with %v", err)
+	}
+
+	expected := append(makeHeader(uint32(xml_command_info_len+4)), xml_command_info...)
+	if !bytes.Equal(w.Bytes(), expected) {
+		t.Error("Written bytes do not match expected frame")
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var w bytes.Buffer
+
+	err := writeFrame(&w, FrameFromString(xml_command_info), uint32(xml_command_info_len+3))
+	if err != ErrFrameTooLarge {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+
+	if w.Len() != 0 {
+		t.Error("Nothing should be written for an oversized frame")
+	}
+}
+
+func TestReadFrameIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server, IdleTimeout(10*time.Millisecond))
+
+	_, err := c.ReadFrame()
+	if !IsTimeout(err) {
+		t.Errorf("Expected TimeoutError, got %v", err)
+	}
+}
+
+func TestReadFrameReadTimeoutAfterHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server, IdleTimeout(time.Second), ReadTimeout(10*time.Millisecond))
+
+	go client.Write(makeHeader(10))
+
+	_, err := c.ReadFrame()
+	if !IsTimeout(err) {
+		t.Errorf("Expected TimeoutError, got %v", err)
+	}
+}
+
+func TestReadFrameEOFIsNotTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := NewConn(server, IdleTimeout(time.Second))
+	client.Close()
+
+	_, err = c.ReadFrame()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestWriteFrameTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server, WriteTimeout(10*time.Millisecond))
+
+	err := c.WriteFrame(FrameFromString(xml_command_info))
+	if !IsTimeout(err) {
+		t.Errorf("Expected TimeoutError, got %v", err)
+	}
+}
+
+func TestReadFrameContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if _, err := c.ReadFrameContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReadFrameContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server, IdleTimeout(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.ReadFrameContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The context's deadline must not outlive it.
+	go client.Write(append(makeHeader(uint32(xml_command_info_len+4)), xml_command_info...))
+
+	if _, err := c.ReadFrame(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestWriteFrameContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := NewConn(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if err := c.WriteFrameContext(ctx, FrameFromString(xml_command_info)); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(append(makeHeader(uint32(xml_command_info_len+4)), xml_command_info...))
+	f.Add(makeHeader(4))
+	f.Add(makeHeader(3))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		frame, err := readFrame(iotest.OneByteReader(bytes.NewReader(input)), 1024)
+		if err != nil {
+			return
+		}
+
+		var w bytes.Buffer
+		if err := writeFrame(&w, frame, 1024); err != nil {
+			t.Fatalf("writeFrame failed on a frame readFrame accepted: %v", err)
+		}
+
+		if !bytes.HasPrefix(input, w.Bytes()) {
+			t.Error("Round-tripped frame does not match input")
+		}
+	})
+}
@@ -1,9 +1,12 @@
 package epp
 
 import (
+	"bytes"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"io"
+	"log/slog"
 
 	"github.com/jteeuwen/go-pkg-xmlx"
 )
@@ -30,6 +33,11 @@ func (f *Frame) IsCommand(cmd string) bool {
 	return f.GetCommand() == cmd
 }
 
+// IsHello reports whether the frame is a hello.
+func (f *Frame) IsHello() bool {
+	return f.getDoc().SelectNode(nsEpp10, "hello") != nil
+}
+
 func (f *Frame) GetCommand() string {
 	doc := f.getDoc()
 	node := doc.SelectNode(nsEpp10, "command")
@@ -63,46 +71,346 @@ func (f *Frame) GetClTRID() string {
 	return ""
 }
 
-func (f *Frame) getDoc() *xmlx.Document {
-	if f.doc != nil {
-		return f.doc
+// GetSvTRID returns the server transaction ID of a response.
+func (f *Frame) GetSvTRID() string {
+	node := f.getDoc().SelectNode(nsEpp10, "trID")
+	if node == nil {
+		return ""
 	}
 
-	f.doc = xmlx.New()
+	return node.S(nsEpp10, "svTRID")
+}
 
-	if err := f.doc.LoadBytes(f.Raw, nil); err != nil {
-		// TODO: handle failure
-		log.Printf("Failed to parse xml; %v", err)
+// GetObjectNames returns the names, or for contacts the IDs, of the objects
+// a command acts on, e.g. every domain of a domain:check.
+func (f *Frame) GetObjectNames() []string {
+	command := f.getDoc().SelectNode(nsEpp10, "command")
+	if command == nil {
 		return nil
 	}
 
-	return f.doc
+	ops := elements(command)
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var names []string
+
+	for _, object := range elements(ops[0]) {
+		for _, child := range elements(object) {
+			if child.Name.Local == "name" || child.Name.Local == "id" {
+				names = append(names, child.GetValue())
+			}
+		}
+	}
+
+	return names
+}
+
+// GetServices returns the namespace of the object a command acts on, empty
+// for commands such as poll and login whose children are EPP's own, and
+// those of its extensions.
+func (f *Frame) GetServices() (objURI string, extURIs []string) {
+	command := f.getDoc().SelectNode(nsEpp10, "command")
+	if command == nil {
+		return "", nil
+	}
+
+	for i, child := range elements(command) {
+		if i == 0 {
+			if objects := elements(child); len(objects) > 0 && objects[0].Name.Space != nsEpp10 {
+				objURI = objects[0].Name.Space
+			}
+			continue
+		}
+
+		if child.Name.Space == nsEpp10 && child.Name.Local == "extension" {
+			for _, ext := range elements(child) {
+				extURIs = append(extURIs, ext.Name.Space)
+			}
+		}
+	}
+
+	return objURI, extURIs
 }
 
-func (f *Frame) MakeSuccessResponse() *Frame {
-	xml := `<?xml version="1.0" encoding="UTF-8" standalone="no"?>\n` +
-		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response>` +
-		`<result code="1000"><msg>Command completed successfully</msg></result>` +
-		`<trID><clTRID>{{clTRID}}</clTRID><svTRID>00000-ZZZ</svTRID></trID>` +
-		`</response></epp>`
+// WithoutExtensions returns a copy of a response without the extension
+// elements outside the keep namespaces, and without its extension element
+// if that leaves it empty. Everything else is left as it was sent. A frame
+// that can't be parsed is returned as it is.
+func (f *Frame) WithoutExtensions(keep []string) *Frame {
+	d := xml.NewDecoder(bytes.NewReader(f.Raw))
+
+	var (
+		path              []xml.Name
+		cuts, extCuts     [][2]int64
+		extStart, elStart int64
+		extKept           bool
+	)
+
+	for {
+		offset := d.InputOffset()
+
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return f
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name)
+
+			if len(path) == 3 && isResponseExtension(path) {
+				extStart, extCuts, extKept = offset, nil, false
+			}
+
+			if len(path) == 4 && isResponseExtension(path[:3]) {
+				elStart = offset
+			}
+
+		case xml.EndElement:
+			if len(path) == 4 && isResponseExtension(path[:3]) {
+				if contains(keep, path[3].Space) {
+					extKept = true
+				} else {
+					extCuts = append(extCuts, [2]int64{elStart, d.InputOffset()})
+				}
+			}
+
+			if len(path) == 3 && isResponseExtension(path) {
+				if !extKept && len(extCuts) > 0 {
+					extCuts = [][2]int64{{extStart, d.InputOffset()}}
+				}
+				cuts = append(cuts, extCuts...)
+			}
+
+			path = path[:len(path)-1]
+		}
+	}
+
+	if len(cuts) == 0 {
+		return f
+	}
+
+	b := make([]byte, 0, len(f.Raw))
+	var last int64
+
+	for _, cut := range cuts {
+		b = append(b, f.Raw[last:cut[0]]...)
+		last = cut[1]
+	}
+
+	b = append(b, f.Raw[last:]...)
 
-	b := []byte(strings.Replace(xml, "{{clTRID}}", f.GetClTRID(), 1))
 	return &Frame{Raw: b, Size: uint32(len(b))}
 }
 
-func (f *Frame) MakeErrorResponse(err error) *Frame {
-	xml := `<?xml version="1.0" encoding="UTF-8" standalone="no"?>\n` +
-		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response>` +
-		`<result code="2400"><msg>{{msg}}</msg></result>` +
-		`<trID><clTRID>{{clTRID}}</clTRID><svTRID>00000-ZZZ</svTRID></trID>` +
-		`</response></epp>`
+// isResponseExtension reports whether path is epp, response, extension.
+func isResponseExtension(path []xml.Name) bool {
+	return path[0] == xml.Name{Space: nsEpp10, Local: "epp"} &&
+		path[1] == xml.Name{Space: nsEpp10, Local: "response"} &&
+		path[2] == xml.Name{Space: nsEpp10, Local: "extension"}
+}
+
+// WithClTRID returns a copy of a command or response with clTRID in place of
+// the contents of its clTRID element. Everything else is left as it was sent.
+// A frame without a clTRID, or that can't be parsed, is returned as it is.
+func (f *Frame) WithClTRID(clTRID string) *Frame {
+	d := xml.NewDecoder(bytes.NewReader(f.Raw))
+
+	var (
+		path  []xml.Name
+		start int64
+	)
+
+	for {
+		offset := d.InputOffset()
+
+		tok, err := d.Token()
+		if err != nil {
+			return f
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name)
+
+			if isClTRID(path) {
+				start = d.InputOffset()
+			}
+
+		case xml.EndElement:
+			// A self-closing element has no contents to replace.
+			if isClTRID(path) {
+				if offset == start {
+					return f
+				}
+
+				var b bytes.Buffer
+				b.Write(f.Raw[:start])
+				xml.EscapeText(&b, []byte(clTRID))
+				b.Write(f.Raw[offset:])
+
+				return &Frame{Raw: b.Bytes(), Size: uint32(b.Len())}
+			}
+
+			path = path[:len(path)-1]
+		}
+	}
+}
+
+// isClTRID reports whether path is epp, command, clTRID or epp, response,
+// trID, clTRID.
+func isClTRID(path []xml.Name) bool {
+	epp := func(local ...string) bool {
+		if len(path) != len(local) {
+			return false
+		}
+
+		for i, name := range path {
+			if name != (xml.Name{Space: nsEpp10, Local: local[i]}) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return epp("epp", "command", "clTRID") || epp("epp", "response", "trID", "clTRID")
+}
 
-	s := strings.Replace(xml, "{{msg}}", err.Error(), 1)
-	b := []byte(strings.Replace(s, "{{clTRID}}", f.GetClTRID(), 1))
+func elements(node *xmlx.Node) []*xmlx.Node {
+	var out []*xmlx.Node
+
+	for _, child := range node.Children {
+		if child.Type == xmlx.NT_ELEMENT {
+			out = append(out, child)
+		}
+	}
+
+	return out
+}
+
+// GetLoginCredentials returns the clID and pw of a login command.
+func (f *Frame) GetLoginCredentials() (clID, pw string) {
+	doc := f.getDoc()
+	node := doc.SelectNode(nsEpp10, "login")
+
+	if node == nil {
+		return "", ""
+	}
+
+	return node.S(nsEpp10, "clID"), node.S(nsEpp10, "pw")
+}
+
+// WithLoginCredentials returns a login command rebuilt with clID and pw in
+// place of the client's, keeping its options, services, extension and clTRID.
+// Any newPW is dropped, since it would change the password of the account
+// the login is now for.
+func (f *Frame) WithLoginCredentials(clID, pw string) (*Frame, error) {
+	m, err := f.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Command == nil || m.Command.Login == nil {
+		return nil, errors.New("failed to replace login credentials; frame is not a login")
+	}
+
+	login := *m.Command.Login
+	login.ClID = clID
+	login.Pw = pw
+	login.NewPW = ""
+
+	cmd := *m.Command
+	cmd.Login = &login
+
+	return MakeCommandFrame(&cmd)
+}
+
+// Redacted returns a copy of the frame with the contents of every pw and
+// newPW element, in any namespace, replaced by REDACTED, for logging. That
+// covers the login passwords and those of object authInfo however they are
+// written, CDATA included. A frame that can't be parsed might hide a password
+// anywhere, so it is redacted whole.
+func (f *Frame) Redacted() *Frame {
+	d := xml.NewDecoder(bytes.NewReader(f.Raw))
+
+	var (
+		cuts  [][2]int64
+		depth int
+		open  int
+		start int64
+	)
+
+	for {
+		offset := d.InputOffset()
+
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b := []byte("REDACTED")
+			return &Frame{Raw: b, Size: uint32(len(b))}
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if open == 0 && isSecret(t.Name) {
+				open, start = depth, d.InputOffset()
+			}
+		case xml.EndElement:
+			// A self-closing element has no contents to replace.
+			if open == depth {
+				if offset > start {
+					cuts = append(cuts, [2]int64{start, offset})
+				}
+				open = 0
+			}
+			depth--
+		}
+	}
+
+	b := make([]byte, 0, len(f.Raw))
+	var last int64
+
+	for _, cut := range cuts {
+		b = append(b, f.Raw[last:cut[0]]...)
+		b = append(b, "REDACTED"...)
+		last = cut[1]
+	}
+
+	b = append(b, f.Raw[last:]...)
 
 	return &Frame{Raw: b, Size: uint32(len(b))}
 }
 
+func isSecret(name xml.Name) bool {
+	return name.Local == "pw" || name.Local == "newPW"
+}
+
+func (f *Frame) getDoc() *xmlx.Document {
+	if f.doc != nil {
+		return f.doc
+	}
+
+	f.doc = xmlx.New()
+
+	if err := f.doc.LoadBytes(f.Raw, nil); err != nil {
+		// Lookups on a frame that isn't XML find nothing rather than
+		// panicking; whoever reads it next will see it fail.
+		slog.Warn("failed to parse xml", "err", err)
+		f.doc.Root = xmlx.NewNode(xmlx.NT_ROOT)
+	}
+
+	return f.doc
+}
+
 func (f *Frame) GetResult() (*Result, error) {
 	doc := f.getDoc()
 	node := doc.SelectNode(nsEpp10, "response")
@@ -141,20 +449,70 @@ func (f *Frame) IsFailure() bool {
 	return result.Code >= 2000
 }
 
-// MakeLoginFrame is not implemented
-//func MakeLoginFrame(clID, password, newPassword, clTRID string, svcs, exts []string) *Frame {
-//	panic(errors.New("not implemented"))
-//	return &Frame{}
-//}
+// MakeFrame encodes m as a frame.
+func MakeFrame(m *Message) (*Frame, error) {
+	b, err := xml.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode frame; %v", err)
+	}
+
+	b = append([]byte(xml.Header), b...)
+
+	return &Frame{Raw: b, Size: uint32(len(b))}, nil
+}
+
+// MakeCommandFrame encodes cmd as a frame, e.g. a domain create:
+//
+//	MakeCommandFrame(&Command{
+//		Create: &Create{Domain: &DomainCreate{Name: "example.com"}},
+//		ClTRID: "ABC-12345",
+//	})
+func MakeCommandFrame(cmd *Command) (*Frame, error) {
+	return MakeFrame(&Message{Command: cmd})
+}
+
+// mustMakeFrame is MakeFrame for messages made of plain strings, which always
+// encode.
+func mustMakeFrame(m *Message) *Frame {
+	f, err := MakeFrame(m)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// MakeLoginFrame makes a login asking for the svcs object and exts extension
+// namespaces. A newPassword, if given, replaces password once the login
+// succeeds.
+func MakeLoginFrame(clID, password, newPassword, clTRID string, svcs, exts []string) *Frame {
+	return mustMakeFrame(&Message{Command: &Command{
+		Login: &Login{
+			ClID:    clID,
+			Pw:      password,
+			NewPW:   newPassword,
+			Options: LoginOptions{Version: "1.0", Lang: "en"},
+			Svcs:    LoginSvcs{ObjURIs: svcs, ExtURIs: exts},
+		},
+		ClTRID: clTRID,
+	}})
+}
 
 func MakeHelloFrame() *Frame {
-	xml := []byte(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>\n` +
-		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><hello/></epp>`)
-	return &Frame{Raw: xml, Size: uint32(len(xml))}
+	return mustMakeFrame(&Message{Hello: &Hello{}})
 }
 
 func MakeLogoutFrame() *Frame {
-	xml := []byte(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>\n` +
-		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><logout/><clTRID>00000-AAA</clTRID></command></epp>`)
-	return &Frame{Raw: xml, Size: uint32(len(xml))}
+	return mustMakeFrame(&Message{Command: &Command{Logout: &Logout{}, ClTRID: "00000-AAA"}})
+}
+
+// MakePollFrame makes a poll request, or with a msgID an acknowledgement of
+// that message.
+func MakePollFrame(msgID, clTRID string) *Frame {
+	poll := &Poll{Op: "req"}
+	if msgID != "" {
+		poll = &Poll{Op: "ack", MsgID: msgID}
+	}
+
+	return mustMakeFrame(&Message{Command: &Command{Poll: poll, ClTRID: clTRID}})
 }
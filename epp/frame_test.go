@@ -113,6 +113,16 @@ func TestGetClTRIDForResponse(t *testing.T) {
 	}
 }
 
+func TestGetSvTRID(t *testing.T) {
+	if svTRID := FrameFromString(xml_response_success).GetSvTRID(); svTRID != "54321-XYZ" {
+		t.Error("Expected '54321-XYZ', got", svTRID)
+	}
+
+	if svTRID := FrameFromString(xml_command_info).GetSvTRID(); svTRID != "" {
+		t.Error("Expected no svTRID for a command, got", svTRID)
+	}
+}
+
 func TestMakeSuccessResponseIncludesClTRID(t *testing.T) {
 	f := FrameFromString(xml_command_info)
 	clTRID := f.GetClTRID()
@@ -137,6 +147,106 @@ func TestMakeErrorResponseIncludesErrorMsgAndClTRID(t *testing.T) {
 	}
 }
 
+func TestMakeResultResponseUsesCode(t *testing.T) {
+	f := FrameFromString(xml_command_login)
+
+	res, err := f.MakeResultResponse(2200, "Authentication error").GetResult()
+	if err != nil {
+		t.Fatalf("GetResult failed with %v", err)
+	}
+
+	if res.Code != 2200 {
+		t.Errorf("Expected 2200, got %v", res.Code)
+	}
+
+	if res.Msg != "Authentication error" {
+		t.Errorf("Expected 'Authentication error', got %v", res.Msg)
+	}
+}
+
+func TestGetLoginCredentials(t *testing.T) {
+	f := FrameFromString(xml_command_login)
+	clID, pw := f.GetLoginCredentials()
+
+	if clID != "client1" {
+		t.Errorf("Expected 'client1', got '%v'", clID)
+	}
+
+	if pw != "XxXxXxXx" {
+		t.Errorf("Expected 'XxXxXxXx', got '%v'", pw)
+	}
+}
+
+func TestGetLoginCredentialsNonLogin(t *testing.T) {
+	f := FrameFromString(xml_command_info)
+	clID, pw := f.GetLoginCredentials()
+
+	if clID != "" || pw != "" {
+		t.Errorf("Expected empty credentials, got '%v', '%v'", clID, pw)
+	}
+}
+
+func TestWithLoginCredentials(t *testing.T) {
+	f, err := FrameFromString(xml_command_login).WithLoginCredentials("REAL-ID", "p<w&d")
+	if err != nil {
+		t.Fatalf("WithLoginCredentials failed with %v", err)
+	}
+
+	clID, pw := f.GetLoginCredentials()
+
+	if clID != "REAL-ID" {
+		t.Errorf("Expected 'REAL-ID', got '%v'", clID)
+	}
+
+	if pw != "p<w&d" {
+		t.Errorf("Expected 'p<w&d', got '%v'", pw)
+	}
+
+	if f.GetClTRID() != "NOIP-X59630bec" {
+		t.Error("Expected clTRID to be kept, got", f.GetClTRID())
+	}
+
+	if svcs := loginSvcs(t, f); len(svcs.ObjURIs) != 2 || len(svcs.ExtURIs) != 4 {
+		t.Errorf("Expected the services to be kept, got %+v", svcs)
+	}
+
+	if int(f.Size) != len(f.Raw) {
+		t.Errorf("Expected size %v, got %v", len(f.Raw), f.Size)
+	}
+}
+
+func TestWithLoginCredentialsDropsNewPW(t *testing.T) {
+	login := strings.Replace(xml_command_login, "<pw>XxXxXxXx</pw>", "<pw><![CDATA[Xx<Xx]]></pw><newPW><![CDATA[NewPass]]></newPW>", 1)
+
+	f, err := FrameFromString(login).WithLoginCredentials("REAL-ID", "real")
+	if err != nil {
+		t.Fatalf("WithLoginCredentials failed with %v", err)
+	}
+
+	if raw := string(f.Raw); strings.Contains(raw, "Xx<Xx") || strings.Contains(raw, "NewPass") || strings.Contains(raw, "newPW") {
+		t.Errorf("Expected the client's pw and newPW to be gone, got %s", f.Raw)
+	}
+
+	if _, pw := f.GetLoginCredentials(); pw != "real" {
+		t.Errorf("Expected 'real', got '%v'", pw)
+	}
+}
+
+func TestWithLoginCredentialsNonLogin(t *testing.T) {
+	if _, err := FrameFromString(xml_command_info).WithLoginCredentials("REAL-ID", "real"); err == nil {
+		t.Error("Expected an error for a command that isn't a login")
+	}
+}
+
+func loginSvcs(t *testing.T, f *Frame) LoginSvcs {
+	m, err := f.Decode()
+	if err != nil || m.Command == nil || m.Command.Login == nil {
+		t.Fatalf("Expected a login, got %s", f.Raw)
+	}
+
+	return m.Command.Login.Svcs
+}
+
 func TestGetResultProvidesCodeAndMsg(t *testing.T) {
 	f := FrameFromString(xml_response_success)
 	res, err := f.GetResult()
@@ -210,3 +320,187 @@ func TestIsFailure(t *testing.T) {
 		}
 	}
 }
+
+func TestRedacted(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><login><clID>client1</clID><pw>secret1</pw><newPW>secret2</newPW></login></command></epp>`)
+
+	raw := string(f.Redacted().Raw)
+
+	if strings.Contains(raw, "secret") {
+		t.Error("Expected passwords to be redacted, got", raw)
+	}
+
+	if !strings.Contains(raw, "<pw>REDACTED</pw>") || !strings.Contains(raw, "<newPW>REDACTED</newPW>") {
+		t.Error("Expected REDACTED in pw and newPW, got", raw)
+	}
+
+	if !strings.Contains(raw, "<clID>client1</clID>") {
+		t.Error("Expected clID to be kept, got", raw)
+	}
+
+	if !strings.Contains(string(f.Raw), "secret1") {
+		t.Error("Redacted should not change the original frame")
+	}
+}
+
+func TestRedactedAuthInfo(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><info><domain:info xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name><domain:authInfo><domain:pw roid="SH8013-REP">2fooBAR</domain:pw></domain:authInfo></domain:info></info></command></epp>`)
+
+	raw := string(f.Redacted().Raw)
+
+	if !strings.Contains(raw, `<domain:pw roid="SH8013-REP">REDACTED</domain:pw>`) {
+		t.Error("Expected authInfo pw to be redacted, got", raw)
+	}
+}
+
+func TestRedactedCDATA(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><login><clID>client1</clID><pw><![CDATA[s3cret]]></pw><newPW>a&amp;<![CDATA[<b>]]></newPW></login></command></epp>`)
+
+	raw := string(f.Redacted().Raw)
+
+	if strings.Contains(raw, "s3cret") || strings.Contains(raw, "CDATA") || strings.Contains(raw, "&amp;") {
+		t.Error("Expected CDATA passwords to be redacted, got", raw)
+	}
+
+	if !strings.Contains(raw, "<pw>REDACTED</pw><newPW>REDACTED</newPW>") {
+		t.Error("Expected REDACTED in pw and newPW, got", raw)
+	}
+}
+
+func TestRedactedEndTagWhitespace(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><info><domain:info xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name><domain:authInfo><domain:pw
+  roid="SH8013-REP" >2fooBAR</domain:pw ></domain:authInfo></domain:info></info><clTRID>ABC-1</clTRID></command></epp>`)
+
+	raw := string(f.Redacted().Raw)
+
+	if strings.Contains(raw, "2fooBAR") {
+		t.Error("Expected authInfo pw to be redacted, got", raw)
+	}
+
+	if !strings.Contains(raw, `roid="SH8013-REP" >REDACTED</domain:pw >`) || !strings.Contains(raw, "<clTRID>ABC-1</clTRID>") {
+		t.Error("Expected only the pw contents to change, got", raw)
+	}
+}
+
+func TestRedactedEmptyAndUnparseable(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><login><clID>client1</clID><pw/></login></command></epp>`)
+
+	if raw := string(f.Redacted().Raw); raw != string(f.Raw) {
+		t.Error("Expected an empty pw to be left alone, got", raw)
+	}
+
+	f = FrameFromString(`<epp><command><login><pw>secret</pw><clID>`)
+
+	if raw := string(f.Redacted().Raw); raw != "REDACTED" {
+		t.Error("Expected an unparseable frame to be redacted whole, got", raw)
+	}
+}
+
+func TestGetObjectNames(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check><domain:check xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>a.com</domain:name><domain:name>b.com</domain:name></domain:check></check><clTRID>ABC-1</clTRID></command></epp>`)
+
+	names := f.GetObjectNames()
+
+	if len(names) != 2 || names[0] != "a.com" || names[1] != "b.com" {
+		t.Errorf("Expected [a.com b.com], got %v", names)
+	}
+
+	f = FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><info><contact:info xmlns:contact="urn:ietf:params:xml:ns:contact-1.0"><contact:id>sh8013</contact:id></contact:info></info></command></epp>`)
+
+	if names := f.GetObjectNames(); len(names) != 1 || names[0] != "sh8013" {
+		t.Errorf("Expected [sh8013], got %v", names)
+	}
+
+	if names := FrameFromString(xml_command_login).GetObjectNames(); len(names) != 0 {
+		t.Errorf("Expected no names for login, got %v", names)
+	}
+}
+
+func TestGetServices(t *testing.T) {
+	f := FrameFromString(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create><domain:create xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name></domain:create></create><extension><secDNS:create xmlns:secDNS="urn:ietf:params:xml:ns:secDNS-1.1"/><fee:create xmlns:fee="urn:example:fee-0.5"/></extension><clTRID>ABC-1</clTRID></command></epp>`)
+
+	objURI, extURIs := f.GetServices()
+
+	if objURI != "urn:ietf:params:xml:ns:domain-1.0" {
+		t.Errorf("Expected domain-1.0, got '%v'", objURI)
+	}
+
+	if len(extURIs) != 2 || extURIs[0] != "urn:ietf:params:xml:ns:secDNS-1.1" || extURIs[1] != "urn:example:fee-0.5" {
+		t.Errorf("Expected secDNS-1.1 and fee-0.5, got %v", extURIs)
+	}
+
+	objURI, extURIs = MakePollFrame("", "ABC-2").GetServices()
+	if objURI != "" || extURIs != nil {
+		t.Errorf("Expected no services for poll, got '%v' and %v", objURI, extURIs)
+	}
+
+	objURI, extURIs = MakeLoginFrame("client1", "secret", "", "ABC-3", []string{"urn:ietf:params:xml:ns:domain-1.0"}, nil).GetServices()
+	if objURI != "" || extURIs != nil {
+		t.Errorf("Expected no services for login, got '%v' and %v", objURI, extURIs)
+	}
+}
+
+const xml_response_extensions = `<?xml version="1.0" encoding="UTF-8"?>
+<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response><result code="1000"><msg>Command completed successfully</msg></result><extension>
+<secDNS:infData xmlns:secDNS="urn:ietf:params:xml:ns:secDNS-1.1"/>
+<rgp:infData xmlns:rgp="urn:ietf:params:xml:ns:rgp-1.0"><rgp:rgpStatus s="addPeriod"/></rgp:infData>
+</extension><trID><svTRID>54321-XYZ</svTRID></trID></response></epp>`
+
+func TestWithoutExtensions(t *testing.T) {
+	f := FrameFromString(xml_response_extensions)
+
+	raw := string(f.WithoutExtensions([]string{"urn:ietf:params:xml:ns:secDNS-1.1"}).Raw)
+
+	if strings.Contains(raw, "rgp") {
+		t.Errorf("Expected rgp to be removed, got %s", raw)
+	}
+
+	if !strings.Contains(raw, `<extension>
+<secDNS:infData xmlns:secDNS="urn:ietf:params:xml:ns:secDNS-1.1"/>`) {
+		t.Errorf("Expected secDNS to be kept as it was, got %s", raw)
+	}
+
+	raw = string(f.WithoutExtensions(nil).Raw)
+
+	if strings.Contains(raw, "extension") || !strings.Contains(raw, "</result><trID>") {
+		t.Errorf("Expected the extension element to be removed, got %s", raw)
+	}
+
+	both := []string{"urn:ietf:params:xml:ns:secDNS-1.1", "urn:ietf:params:xml:ns:rgp-1.0"}
+	if g := f.WithoutExtensions(both); g != f {
+		t.Errorf("Expected the frame back when everything is kept, got %s", g.Raw)
+	}
+
+	bad := FrameFromString(`<epp><response><extension><x/>`)
+	if g := bad.WithoutExtensions(nil); g != bad {
+		t.Errorf("Expected a malformed frame back as it was, got %s", g.Raw)
+	}
+}
+
+func TestWithClTRID(t *testing.T) {
+	f := FrameFromString(xml_command_info).WithClTRID("A&B-1")
+
+	if clTRID := f.GetClTRID(); clTRID != "A&B-1" {
+		t.Errorf("Expected the command's clTRID to be replaced, got '%s'", clTRID)
+	}
+
+	if !strings.Contains(string(f.Raw), "<clTRID>A&amp;B-1</clTRID></command></epp>") || f.Size != uint32(len(f.Raw)) {
+		t.Errorf("Expected only the clTRID to change, got %s", f.Raw)
+	}
+
+	f = FrameFromString(xml_response_success).WithClTRID("B-2")
+
+	if f.GetClTRID() != "B-2" || f.GetSvTRID() != "54321-XYZ" {
+		t.Errorf("Expected the response's clTRID to be replaced, got %s", f.Raw)
+	}
+
+	for _, raw := range []string{
+		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><hello/></epp>`,
+		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><poll op="req"/><clTRID/></command></epp>`,
+		`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><clTRID>`,
+	} {
+		if g := FrameFromString(raw); g.WithClTRID("X-1") != g {
+			t.Errorf("Expected a frame without a clTRID back as it was, got %s", g.WithClTRID("X-1").Raw)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package epp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Greeting is what a registry offers in its greeting (RFC 5730 section 2.4).
+type Greeting struct {
+	SvID string
+
+	// SvDate is zero if the registry sent one that isn't an RFC 3339 time.
+	SvDate time.Time
+
+	Versions []string
+	Langs    []string
+	ObjURIs  []string
+	ExtURIs  []string
+}
+
+type greetingMessage struct {
+	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:epp-1.0 epp"`
+	Greeting *struct {
+		SvID     string   `xml:"svID"`
+		SvDate   string   `xml:"svDate"`
+		Versions []string `xml:"svcMenu>version"`
+		Langs    []string `xml:"svcMenu>lang"`
+		ObjURIs  []string `xml:"svcMenu>objURI"`
+		ExtURIs  []string `xml:"svcMenu>svcExtension>extURI"`
+	} `xml:"greeting"`
+}
+
+var errNotGreeting = errors.New("not a greeting")
+
+// DecodeGreeting parses the frame as a greeting.
+func (f *Frame) DecodeGreeting() (*Greeting, error) {
+	var m greetingMessage
+
+	if err := xml.Unmarshal(f.Raw, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode greeting; %v", err)
+	}
+
+	if m.Greeting == nil {
+		return nil, fmt.Errorf("failed to decode greeting; %v", errNotGreeting)
+	}
+
+	g := &Greeting{
+		SvID:     m.Greeting.SvID,
+		Versions: m.Greeting.Versions,
+		Langs:    m.Greeting.Langs,
+		ObjURIs:  m.Greeting.ObjURIs,
+		ExtURIs:  m.Greeting.ExtURIs,
+	}
+
+	if t, err := time.Parse(time.RFC3339, m.Greeting.SvDate); err == nil {
+		g.SvDate = t
+	}
+
+	return g, nil
+}
+
+// Unsupported returns the objURIs and extURIs in svcs that the registry
+// doesn't offer.
+func (g *Greeting) Unsupported(svcs LoginSvcs) (objURIs, extURIs []string) {
+	return missing(svcs.ObjURIs, g.ObjURIs), missing(svcs.ExtURIs, g.ExtURIs)
+}
+
+// Services asks for every object and extension the registry offers.
+func (g *Greeting) Services() LoginSvcs {
+	return LoginSvcs{ObjURIs: g.ObjURIs, ExtURIs: g.ExtURIs}
+}
+
+// MakeLoginFrame makes a login asking for every service the registry offers,
+// in a version and language it supports, preferring 1.0 and English.
+func (g *Greeting) MakeLoginFrame(clID, password, clTRID string) *Frame {
+	return mustMakeFrame(&Message{Command: &Command{
+		Login: &Login{
+			ClID: clID,
+			Pw:   password,
+			Options: LoginOptions{
+				Version: prefer("1.0", g.Versions),
+				Lang:    prefer("en", g.Langs),
+			},
+			Svcs: g.Services(),
+		},
+		ClTRID: clTRID,
+	}})
+}
+
+// prefer returns want if it is offered or nothing is, otherwise the first
+// offered.
+func prefer(want string, offered []string) string {
+	if len(offered) == 0 || contains(offered, want) {
+		return want
+	}
+
+	return offered[0]
+}
+
+func missing(want, offered []string) []string {
+	var out []string
+
+	for _, s := range want {
+		if !contains(offered, s) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
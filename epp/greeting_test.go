@@ -0,0 +1,135 @@
+package epp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const xml_greeting = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<epp xmlns="urn:ietf:params:xml:ns:epp-1.0">
+  <greeting>
+    <svID>Example EPP server epp.example.com</svID>
+    <svDate>2000-06-08T22:00:00.0Z</svDate>
+    <svcMenu>
+      <version>1.0</version>
+      <lang>fr</lang>
+      <lang>en</lang>
+      <objURI>urn:ietf:params:xml:ns:domain-1.0</objURI>
+      <objURI>urn:ietf:params:xml:ns:host-1.0</objURI>
+      <svcExtension>
+        <extURI>urn:ietf:params:xml:ns:secDNS-1.1</extURI>
+      </svcExtension>
+    </svcMenu>
+    <dcp>
+      <access><all/></access>
+      <statement>
+        <purpose><admin/><prov/></purpose>
+        <recipient><ours/><public/></recipient>
+        <retention><stated/></retention>
+      </statement>
+    </dcp>
+  </greeting>
+</epp>`
+
+func TestDecodeGreeting(t *testing.T) {
+	g, err := FrameFromString(xml_greeting).DecodeGreeting()
+	if err != nil {
+		t.Fatalf("DecodeGreeting failed with %v", err)
+	}
+
+	want := &Greeting{
+		SvID:     "Example EPP server epp.example.com",
+		SvDate:   time.Date(2000, 6, 8, 22, 0, 0, 0, time.UTC),
+		Versions: []string{"1.0"},
+		Langs:    []string{"fr", "en"},
+		ObjURIs:  []string{"urn:ietf:params:xml:ns:domain-1.0", "urn:ietf:params:xml:ns:host-1.0"},
+		ExtURIs:  []string{"urn:ietf:params:xml:ns:secDNS-1.1"},
+	}
+
+	if !g.SvDate.Equal(want.SvDate) {
+		t.Errorf("Expected svDate %v, got %v", want.SvDate, g.SvDate)
+	}
+
+	g.SvDate = want.SvDate
+
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("Expected %+v, got %+v", want, g)
+	}
+}
+
+func TestDecodeGreetingNotGreeting(t *testing.T) {
+	if _, err := FrameFromString(xml_command_info).DecodeGreeting(); err == nil {
+		t.Error("Expected an error decoding a command as a greeting")
+	}
+}
+
+func TestGreetingUnsupported(t *testing.T) {
+	g, _ := FrameFromString(xml_greeting).DecodeGreeting()
+
+	objURIs, extURIs := g.Unsupported(LoginSvcs{
+		ObjURIs: []string{"urn:ietf:params:xml:ns:domain-1.0", "urn:ietf:params:xml:ns:contact-1.0"},
+		ExtURIs: []string{"urn:ietf:params:xml:ns:secDNS-1.1", "urn:ietf:params:xml:ns:rgp-1.0"},
+	})
+
+	if !reflect.DeepEqual(objURIs, []string{"urn:ietf:params:xml:ns:contact-1.0"}) {
+		t.Errorf("Expected contact-1.0 unsupported, got %v", objURIs)
+	}
+
+	if !reflect.DeepEqual(extURIs, []string{"urn:ietf:params:xml:ns:rgp-1.0"}) {
+		t.Errorf("Expected rgp-1.0 unsupported, got %v", extURIs)
+	}
+
+	objURIs, extURIs = g.Unsupported(g.Services())
+	if objURIs != nil || extURIs != nil {
+		t.Errorf("Expected everything offered to be supported, got %v and %v", objURIs, extURIs)
+	}
+}
+
+func TestGreetingMakeLoginFrame(t *testing.T) {
+	g, _ := FrameFromString(xml_greeting).DecodeGreeting()
+	g.Langs = []string{"fr"}
+
+	m, err := g.MakeLoginFrame("ClientX", "foo-BAR2", "ABC-12345").Decode()
+	if err != nil {
+		t.Fatalf("Decode failed with %v", err)
+	}
+
+	login := m.Command.Login
+
+	if login.Options.Version != "1.0" || login.Options.Lang != "fr" {
+		t.Errorf("Expected version 1.0 and lang fr, got %+v", login.Options)
+	}
+
+	if !reflect.DeepEqual(login.Svcs, g.Services()) {
+		t.Errorf("Expected every service offered, got %+v", login.Svcs)
+	}
+}
+
+func TestClientGreeting(t *testing.T) {
+	client, registry := net.Pipe()
+	defer registry.Close()
+
+	c := NewClient(client)
+	defer c.Close()
+
+	if _, err := c.Greeting(); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected before the greeting, got %v", err)
+	}
+
+	go NewConn(registry).WriteFrame(FrameFromString(xml_greeting))
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed with %v", err)
+	}
+
+	g, err := c.Greeting()
+	if err != nil {
+		t.Fatalf("Greeting failed with %v", err)
+	}
+
+	if g.SvID != "Example EPP server epp.example.com" {
+		t.Errorf("Expected the registry's svID, got '%v'", g.SvID)
+	}
+}
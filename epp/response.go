@@ -0,0 +1,119 @@
+package epp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"strconv"
+	"sync/atomic"
+)
+
+// SvTRIDPrefix starts the svTRID of every response made by the proxy rather
+// than a registry.
+const SvTRIDPrefix = "epplb-"
+
+var (
+	// svTRIDRun tells apart the svTRIDs of different runs of the proxy, whose
+	// counters all start at zero.
+	svTRIDRun = func() string {
+		b := make([]byte, 4)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}()
+
+	svTRIDCount uint64
+)
+
+// newSvTRID returns an svTRID unique to this response, e.g.
+// epplb-1a2b3c4d-42.
+func newSvTRID() string {
+	n := atomic.AddUint64(&svTRIDCount, 1)
+	return SvTRIDPrefix + svTRIDRun + "-" + strconv.FormatUint(n, 10)
+}
+
+type ResponseOption func(*response)
+
+// Lang sets the language of the message and reasons, which is English if
+// not given.
+func Lang(lang string) ResponseOption {
+	return func(r *response) {
+		r.Result.Msg.Lang = lang
+	}
+}
+
+// ExtValue explains the error with value, the XML of the element that caused
+// it as the client sent it, and a reason.
+func ExtValue(value, reason string) ResponseOption {
+	return func(r *response) {
+		r.Result.ExtValues = append(r.Result.ExtValues, extValue{
+			Value:  rawXML{XML: value},
+			Reason: responseText{Text: reason},
+		})
+	}
+}
+
+type response struct {
+	XMLName xml.Name       `xml:"urn:ietf:params:xml:ns:epp-1.0 epp"`
+	Result  responseResult `xml:"response>result"`
+	TrID    responseTrID   `xml:"response>trID"`
+}
+
+type responseResult struct {
+	Code      uint16       `xml:"code,attr"`
+	Msg       responseText `xml:"msg"`
+	ExtValues []extValue   `xml:"extValue"`
+}
+
+type responseText struct {
+	Lang string `xml:"lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type extValue struct {
+	Value  rawXML       `xml:"value"`
+	Reason responseText `xml:"reason"`
+}
+
+type rawXML struct {
+	XML string `xml:",innerxml"`
+}
+
+type responseTrID struct {
+	ClTRID string `xml:"clTRID,omitempty"`
+	SvTRID string `xml:"svTRID"`
+}
+
+func (f *Frame) MakeSuccessResponse() *Frame {
+	return f.MakeResultResponse(1000, "Command completed successfully")
+}
+
+func (f *Frame) MakeErrorResponse(err error) *Frame {
+	return f.MakeResultResponse(2400, err.Error())
+}
+
+// MakeResultResponse makes a response to f with the given result code and
+// message. Its svTRID starts with SvTRIDPrefix and is never reused.
+func (f *Frame) MakeResultResponse(code uint16, msg string, options ...ResponseOption) *Frame {
+	r := response{
+		Result: responseResult{Code: code, Msg: responseText{Text: msg}},
+		TrID:   responseTrID{ClTRID: f.GetClTRID(), SvTRID: newSvTRID()},
+	}
+
+	for _, opt := range options {
+		opt(&r)
+	}
+
+	for i := range r.Result.ExtValues {
+		r.Result.ExtValues[i].Reason.Lang = r.Result.Msg.Lang
+	}
+
+	b, err := xml.Marshal(r)
+	if err != nil {
+		// Everything in a response is a string or a number.
+		panic(err)
+	}
+
+	b = append([]byte(xml.Header), b...)
+
+	return &Frame{Raw: b, Size: uint32(len(b))}
+}
@@ -0,0 +1,85 @@
+package epp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMakeResultResponseEscapes(t *testing.T) {
+	f := FrameFromString(xml_command_info)
+
+	res := f.MakeResultResponse(2400, `bad <thing> & "more"`)
+
+	if !strings.HasPrefix(string(res.Raw), `<?xml version="1.0" encoding="UTF-8"?>`+"\n<epp") {
+		t.Errorf("Expected an XML declaration then epp, got %s", res.Raw)
+	}
+
+	result, err := res.GetResult()
+	if err != nil {
+		t.Fatalf("GetResult failed with %v", err)
+	}
+
+	if result.Msg != `bad <thing> & "more"` {
+		t.Errorf("Expected the message back, got '%v'", result.Msg)
+	}
+
+	if !strings.Contains(string(res.Raw), "<msg>bad &lt;thing&gt; &amp; &#34;more&#34;</msg>") {
+		t.Errorf("Expected the message escaped, got %s", res.Raw)
+	}
+}
+
+func TestMakeResultResponseSvTRIDs(t *testing.T) {
+	f := FrameFromString(xml_command_info)
+
+	a := f.MakeSuccessResponse().GetSvTRID()
+	b := f.MakeSuccessResponse().GetSvTRID()
+
+	if !strings.HasPrefix(a, SvTRIDPrefix) {
+		t.Errorf("Expected svTRID to start with %s, got '%v'", SvTRIDPrefix, a)
+	}
+
+	if a == b {
+		t.Errorf("Expected unique svTRIDs, got '%v' twice", a)
+	}
+
+	if len(a) < 3 || len(a) > 64 {
+		t.Errorf("Expected svTRID of 3 to 64 characters, got '%v'", a)
+	}
+}
+
+func TestMakeResultResponseLangAndExtValue(t *testing.T) {
+	f := FrameFromString(xml_command_info)
+
+	res := f.MakeResultResponse(2004, "Parameter value range error",
+		Lang("fr"),
+		ExtValue(`<obj:name xmlns:obj="urn:ietf:params:xml:ns:obj">example</obj:name>`, "name < 3 chars"),
+	)
+
+	raw := string(res.Raw)
+
+	if !strings.Contains(raw, `<msg lang="fr">Parameter value range error</msg>`) {
+		t.Errorf("Expected a French msg, got %s", raw)
+	}
+
+	expected := `<extValue><value><obj:name xmlns:obj="urn:ietf:params:xml:ns:obj">example</obj:name></value><reason lang="fr">name &lt; 3 chars</reason></extValue>`
+	if !strings.Contains(raw, expected) {
+		t.Errorf("Expected %s in %s", expected, raw)
+	}
+
+	if result, err := res.GetResult(); err != nil || result.Code != 2004 {
+		t.Errorf("Expected code 2004, got %+v, %v", result, err)
+	}
+}
+
+func TestMakeResultResponseWithoutClTRID(t *testing.T) {
+	res := MakeHelloFrame().MakeErrorResponse(errors.New("foo"))
+
+	if strings.Contains(string(res.Raw), "clTRID") {
+		t.Errorf("Expected no clTRID, got %s", res.Raw)
+	}
+
+	if res.GetSvTRID() == "" {
+		t.Errorf("Expected an svTRID, got %s", res.Raw)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/rfc5734"
+)
+
+// Gateway lets clients POST a single EPP command document over HTTP instead
+// of speaking RFC 5734. Each request is played through the proxy's handler as
+// a short downstream session: greeting, login with the request's basic auth
+// credentials, the command, and logout. Auth, routing, retries and metrics
+// are therefore the same as for TCP clients.
+type Gateway struct {
+	Name         string
+	handle       rfc5734.Handler
+	timeout      time.Duration
+	maxFrameSize uint32
+	server       *http.Server
+}
+
+func NewGateway(name, addr string, handle rfc5734.Handler, timeout time.Duration, maxFrameSize uint32) *Gateway {
+	g := &Gateway{
+		Name:         name,
+		handle:       handle,
+		timeout:      timeout,
+		maxFrameSize: maxFrameSize,
+	}
+
+	g.server = &http.Server{
+		Addr:         addr,
+		Handler:      g,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: timeout + 10*time.Second,
+	}
+
+	return g
+}
+
+// Start listens on the gateway's address, with TLS if tlsConfig is set.
+func (g *Gateway) Start(tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", g.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen; address=%s, err=%v", g.server.Addr, err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	go func() {
+		if err := g.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("http gateway error", "proxy", g.Name, "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops accepting requests and waits for those in flight.
+func (g *Gateway) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	g.server.Shutdown(ctx)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clID, pw, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="epplb"`)
+		http.Error(w, "basic auth with clID and pw is required", http.StatusUnauthorized)
+		return
+	}
+
+	// The body becomes a frame with a four byte header.
+	limit := int64(g.maxFrameSize) - 4
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(body)) > limit {
+		http.Error(w, "body is larger than the maximum frame size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !wellFormed(body) {
+		http.Error(w, "body is not well-formed XML", http.StatusBadRequest)
+		return
+	}
+
+	cmd := &epp.Frame{Raw: body, Size: uint32(len(body))}
+
+	switch cmd.GetCommand() {
+	case "":
+		http.Error(w, "body is not an EPP command", http.StatusBadRequest)
+		return
+	case "login", "logout":
+		http.Error(w, "login and logout are handled by the gateway", http.StatusBadRequest)
+		return
+	}
+
+	response, err := g.roundTrip(r, clID, pw, cmd)
+	if err != nil {
+		slog.Warn("http gateway failed", "proxy", g.Name, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, "upstream failure", http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusBadGateway
+	if result, err := response.GetResult(); err == nil {
+		w.Header().Set("X-EPP-Result-Code", strconv.Itoa(int(result.Code)))
+		status = httpStatus(result.Code)
+	}
+
+	w.Header().Set("Content-Type", "application/epp+xml")
+	w.WriteHeader(status)
+	w.Write(response.Raw)
+}
+
+// roundTrip runs one downstream session against the handler over an
+// in-memory pipe and returns the response to cmd, or to the login if that
+// failed.
+func (g *Gateway) roundTrip(r *http.Request, clID, pw string, cmd *epp.Frame) (*epp.Frame, error) {
+	// The session ends when the HTTP client goes away or the timeout is up.
+	ctx, cancel := context.WithTimeout(r.Context(), g.timeout)
+	defer cancel()
+
+	client, server := net.Pipe()
+
+	downstream := &gatewayConn{
+		Conn:       server,
+		remoteAddr: httpAddr(r.RemoteAddr),
+		confirm:    r.Header.Get("X-EPP-Confirm"),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		downstream.subject = r.TLS.PeerCertificates[0].Subject.String()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		if err := g.handle(ctx, downstream); err != nil {
+			slog.Error("connection error", "proxy", g.Name, "downstream", downstream.RemoteAddr().String(), "err", err)
+		}
+	}()
+
+	// Closing our end ends the session if we return before logging out.
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	conn := epp.NewConn(client, epp.MaxFrameSize(g.maxFrameSize))
+
+	greeting, err := conn.ReadFrameContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read greeting; %v", err)
+	}
+
+	login, err := makeGatewayLogin(clID, pw, greeting)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read greeting; %v", err)
+	}
+
+	response, err := exchange(ctx, conn, login)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in; %v", err)
+	}
+
+	if !response.IsSuccess() {
+		return response, nil
+	}
+
+	response, err = exchange(ctx, conn, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response is already in hand; a failed logout only matters to the
+	// proxy.
+	exchange(ctx, conn, epp.MakeLogoutFrame())
+
+	return response, nil
+}
+
+func exchange(ctx context.Context, conn *epp.Conn, f *epp.Frame) (*epp.Frame, error) {
+	if err := conn.WriteFrameContext(ctx, f); err != nil {
+		return nil, err
+	}
+
+	return conn.ReadFrameContext(ctx)
+}
+
+// gatewayConn is the proxy's end of a gateway pipe. It reports the HTTP
+// client's address and certificate subject so logs and identity mapping work
+// as they do for TCP clients, and the command its X-EPP-Confirm header
+// confirms.
+type gatewayConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	subject    string
+	confirm    string
+}
+
+func (c *gatewayConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *gatewayConn) PeerSubject() string {
+	return c.subject
+}
+
+func (c *gatewayConn) Confirmation() string {
+	return c.confirm
+}
+
+// confirmation returns the command a downstream connection has confirmed
+// the client means to send. Only gateway connections can confirm one.
+func confirmation(c net.Conn) string {
+	if g, ok := c.(interface{ Confirmation() string }); ok {
+		return g.Confirmation()
+	}
+
+	return ""
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+func wellFormed(b []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(b))
+
+	for {
+		if _, err := d.Token(); err != nil {
+			return err == io.EOF
+		}
+	}
+}
+
+// makeGatewayLogin builds a login that asks for every service the greeting
+// offers.
+func makeGatewayLogin(clID, pw string, greeting *epp.Frame) (*epp.Frame, error) {
+	g, err := greeting.DecodeGreeting()
+	if err != nil {
+		return nil, err
+	}
+
+	return g.MakeLoginFrame(clID, pw, "epplb-http-login"), nil
+}
+
+// httpStatus maps an EPP result code to the closest HTTP status.
+func httpStatus(code uint16) int {
+	switch {
+	case code >= 1000 && code < 2000:
+		return http.StatusOK
+	case code == 2104:
+		return http.StatusPaymentRequired
+	case code == 2105, code == 2106:
+		return http.StatusConflict
+	case code >= 2100 && code < 2200, code == 2307:
+		return http.StatusNotImplemented
+	case code == 2200:
+		return http.StatusUnauthorized
+	case code == 2201, code == 2202:
+		return http.StatusForbidden
+	case code == 2303:
+		return http.StatusNotFound
+	case code == 2306, code == 2308:
+		return http.StatusUnprocessableEntity
+	case code >= 2300 && code < 2400:
+		return http.StatusConflict
+	case code >= 2000 && code < 2100:
+		return http.StatusBadRequest
+	case code == 2400:
+		return http.StatusBadGateway
+	case code >= 2500 && code < 2600:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+// stubProxy stands in for the proxy's handler. It accepts the password
+// "secret", answers commands with code and records what the gateway sent.
+type stubProxy struct {
+	code uint16
+
+	mu       sync.Mutex
+	commands []string
+	clID     string
+	confirm  string
+	remote   string
+}
+
+func (s *stubProxy) handle(ctx context.Context, c net.Conn) error {
+	s.mu.Lock()
+	s.confirm = confirmation(c)
+	s.remote = c.RemoteAddr().String()
+	s.mu.Unlock()
+
+	conn := epp.NewConn(c)
+
+	if err := conn.WriteFrame(epp.FrameFromString(testGreeting)); err != nil {
+		return err
+	}
+
+	for {
+		f, err := conn.ReadFrame()
+		if err != nil {
+			return nil
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, f.GetCommand())
+		s.mu.Unlock()
+
+		var response *epp.Frame
+
+		switch {
+		case f.IsCommand("login"):
+			clID, pw := f.GetLoginCredentials()
+			s.mu.Lock()
+			s.clID = clID
+			s.mu.Unlock()
+
+			response = f.MakeSuccessResponse()
+			if pw != "secret" {
+				response = f.MakeResultResponse(2200, "Authentication error")
+			}
+		case f.IsCommand("logout"):
+			return conn.WriteFrame(f.MakeResultResponse(1500, "Command completed successfully; ending session"))
+		case s.code == 1000:
+			response = registryResponse(f.GetClTRID())
+		default:
+			response = f.MakeResultResponse(s.code, "Stubbed")
+		}
+
+		if err := conn.WriteFrame(response); err != nil {
+			return err
+		}
+	}
+}
+
+func post(g *Gateway, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.SetBasicAuth("client1", "secret")
+
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestGatewayRoundTrip(t *testing.T) {
+	stub := &stubProxy{code: 1000}
+	g := NewGateway("test", "", stub.handle, time.Second, epp.DefaultMaxFrameSize)
+
+	w := post(g, testCheck, http.Header{"X-Epp-Confirm": {"delete"}})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	if code := w.Header().Get("X-EPP-Result-Code"); code != "1000" {
+		t.Errorf("Expected X-EPP-Result-Code 1000, got '%s'", code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/epp+xml" {
+		t.Errorf("Expected application/epp+xml, got '%s'", ct)
+	}
+
+	if !strings.Contains(w.Body.String(), "<svTRID>REG-CL-2</svTRID>") {
+		t.Errorf("Expected the response to the check, got %s", w.Body.String())
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if strings.Join(stub.commands, ",") != "login,check,logout" {
+		t.Errorf("Expected login, check and logout, got %v", stub.commands)
+	}
+
+	if stub.clID != "client1" {
+		t.Errorf("Expected the basic auth clID, got '%s'", stub.clID)
+	}
+
+	if stub.confirm != "delete" {
+		t.Errorf("Expected the X-EPP-Confirm header to reach the handler, got '%s'", stub.confirm)
+	}
+
+	if stub.remote != "192.0.2.1:1234" {
+		t.Errorf("Expected the HTTP client's address, got '%s'", stub.remote)
+	}
+}
+
+func TestGatewayResultCode(t *testing.T) {
+	stub := &stubProxy{code: 2303}
+	g := NewGateway("test", "", stub.handle, time.Second, epp.DefaultMaxFrameSize)
+
+	w := post(g, testCheck, nil)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+
+	if code := w.Header().Get("X-EPP-Result-Code"); code != "2303" {
+		t.Errorf("Expected X-EPP-Result-Code 2303, got '%s'", code)
+	}
+}
+
+func TestGatewayLoginRefused(t *testing.T) {
+	stub := &stubProxy{code: 1000}
+	g := NewGateway("test", "", stub.handle, time.Second, epp.DefaultMaxFrameSize)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(testCheck))
+	r.SetBasicAuth("client1", "wrong")
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized || w.Header().Get("X-EPP-Result-Code") != "2200" {
+		t.Errorf("Expected 401 with 2200, got %d with '%s'", w.Code, w.Header().Get("X-EPP-Result-Code"))
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if strings.Join(stub.commands, ",") != "login" {
+		t.Errorf("Expected only the login to be sent, got %v", stub.commands)
+	}
+}
+
+func TestGatewayRejectsRequests(t *testing.T) {
+	stub := &stubProxy{code: 1000}
+	g := NewGateway("test", "", stub.handle, time.Second, epp.DefaultMaxFrameSize)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		auth   bool
+		body   string
+		status int
+		header string
+	}{
+		{"get", http.MethodGet, true, "", http.StatusMethodNotAllowed, "Allow"},
+		{"no auth", http.MethodPost, false, testCheck, http.StatusUnauthorized, "WWW-Authenticate"},
+		{"malformed", http.MethodPost, true, "<epp>", http.StatusBadRequest, ""},
+		{"hello", http.MethodPost, true, string(epp.MakeHelloFrame().Raw), http.StatusBadRequest, ""},
+		{"login", http.MethodPost, true, string(testLogin().Raw), http.StatusBadRequest, ""},
+		{"logout", http.MethodPost, true, string(epp.MakeLogoutFrame().Raw), http.StatusBadRequest, ""},
+	} {
+		r := httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+		if tc.auth {
+			r.SetBasicAuth("client1", "secret")
+		}
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, w.Code)
+		}
+
+		if tc.header != "" && w.Header().Get(tc.header) == "" {
+			t.Errorf("%s: expected a %s header", tc.name, tc.header)
+		}
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if len(stub.commands) != 0 {
+		t.Errorf("Expected nothing to reach the handler, got %v", stub.commands)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	for _, tc := range []struct {
+		code   uint16
+		status int
+	}{
+		{1000, http.StatusOK},
+		{1301, http.StatusOK},
+		{2001, http.StatusBadRequest},
+		{2101, http.StatusNotImplemented},
+		{2103, http.StatusNotImplemented},
+		{2104, http.StatusPaymentRequired},
+		{2105, http.StatusConflict},
+		{2106, http.StatusConflict},
+		{2200, http.StatusUnauthorized},
+		{2201, http.StatusForbidden},
+		{2202, http.StatusForbidden},
+		{2302, http.StatusConflict},
+		{2303, http.StatusNotFound},
+		{2306, http.StatusUnprocessableEntity},
+		{2307, http.StatusNotImplemented},
+		{2308, http.StatusUnprocessableEntity},
+		{2400, http.StatusBadGateway},
+		{2502, http.StatusServiceUnavailable},
+		{3000, http.StatusInternalServerError},
+	} {
+		if status := httpStatus(tc.code); status != tc.status {
+			t.Errorf("Expected %d for %d, got %d", tc.status, tc.code, status)
+		}
+	}
+}
+
+func TestGatewayFrameTooLarge(t *testing.T) {
+	stub := &stubProxy{code: 1000}
+	g := NewGateway("test", "", stub.handle, time.Second, uint32(len(testCheck)+3))
+
+	if w := post(g, testCheck, nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", w.Code)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if len(stub.commands) != 0 {
+		t.Errorf("Expected nothing to reach the handler, got %v", stub.commands)
+	}
+}
+
+// gatewayIdentitySession starts the proxy's gateway for config in front of a
+// ProxyHandler whose TCP listener maps client1's certificate, posts a check,
+// over TLS as client1's certificate if config has TLS, and returns the result
+// and what reached the registry.
+func gatewayIdentitySession(t *testing.T, config *HTTPConfig) (*httptest.ResponseRecorder, string) {
+	upstreams, commands := registrySource(t)
+
+	h := ProxyHandler{
+		Name:       "test",
+		upstreams:  upstreams,
+		Identities: map[string]string{"CN=client1,O=Example": "client1"},
+	}
+
+	p := NewProxy(ProxyConfig{Name: "test", MaxFrameSize: epp.DefaultMaxFrameSize})
+
+	if err := p.startGateway(config, h); err != nil {
+		t.Fatalf("startGateway failed with %v", err)
+	}
+	defer p.gateway.Stop()
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(testCheck))
+	r.SetBasicAuth("client1", "secret")
+
+	if config.TLS != nil {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "client1", Organization: []string{"Example"}}},
+		}}
+	}
+
+	w := httptest.NewRecorder()
+	p.gateway.ServeHTTP(w, r)
+
+	var received []string
+	for len(commands) > 0 {
+		received = append(received, <-commands)
+	}
+
+	return w, strings.Join(received, ",")
+}
+
+func TestGatewayIgnoresDownstreamIdentities(t *testing.T) {
+	w, received := gatewayIdentitySession(t, &HTTPConfig{Listen: "127.0.0.1:0", Timeout: Duration(time.Second)})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the downstream identities not to apply to the gateway, got %d with '%s'", w.Code, w.Header().Get("X-EPP-Result-Code"))
+	}
+
+	if !strings.HasPrefix(received, "login,check") {
+		t.Errorf("Expected the login and check to reach the registry, got %s", received)
+	}
+}
+
+func TestGatewayIdentities(t *testing.T) {
+	pki := newTestPKI(t)
+
+	w, received := gatewayIdentitySession(t, &HTTPConfig{
+		Listen:  "127.0.0.1:0",
+		Timeout: Duration(time.Second),
+		TLS: &ServerTLSConfig{
+			Cert:       pki.Cert,
+			Key:        pki.Key,
+			ClientCA:   pki.CA,
+			Identities: map[string]string{"CN=client1,O=Example": "client2"},
+		},
+	})
+
+	if w.Code != http.StatusUnauthorized || w.Header().Get("X-EPP-Result-Code") != "2200" {
+		t.Errorf("Expected the http identities to refuse client1, got %d with '%s'", w.Code, w.Header().Get("X-EPP-Result-Code"))
+	}
+
+	if received != "" {
+		t.Errorf("Expected nothing to reach the registry, got %s", received)
+	}
+}
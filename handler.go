@@ -1,86 +1,232 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 
-	pool "gopkg.in/fatih/pool.v2"
-
+	"github.com/davidrjonas/epplb/audit"
 	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/policy"
+	"github.com/davidrjonas/epplb/xsd"
 )
 
+// Account is a registry account that downstream logins with a matching clID
+// are sent to. It has its own pool so commands always run under it. ClID and
+// Password are empty for a client that logs in with its own credentials.
+type Account struct {
+	ClID      string
+	Password  string
+	upstreams upstreamSource
+}
+
 type ProxyHandler struct {
-	pool       pool.Pool
-	MaxRetries uint8
+	Name              string
+	upstreams         upstreamSource
+	MaxRetries        uint8
+	Auth              Authenticator
+	Accounts          map[string]*Account
+	Identities        map[string]string
+	DownstreamOptions []epp.ConnOption
+	Audit             *audit.Log
+	Schema            *xsd.Schema
+	Policy            *policy.Policy
 }
 
-func (h *ProxyHandler) logf(format string, v ...interface{}) {
-	log.Printf(format, v...)
+// session tracks which pool and upstream session a downstream connection is
+// currently using.
+type session struct {
+	source   upstreamSource
+	upstream *epp.Client
 }
 
-func (h *ProxyHandler) Handle(c net.Conn) error {
-	upstream, err := h.pool.Get()
+// Handle proxies one downstream connection until it logs out, disconnects or
+// ctx is done.
+func (h *ProxyHandler) Handle(ctx context.Context, c net.Conn) error {
+	downstreamConnections.With(h.Name).Inc()
+
+	s := &session{source: h.upstreams}
+
+	id := newSessionID()
+	logger := slog.With("session", id, "proxy", h.Name, "downstream", c.RemoteAddr().String())
+
+	upstream, err := h.upstream(s)
 
 	if err != nil {
+		logger.Error("failed to get upstream session", "err", err)
 		return err
 	}
 
+	defer h.release(s, true)
+
 	p := &Protocol{
-		Upstream:   epp.NewClient(upstream),
-		Downstream: epp.NewConn(c),
+		Upstream:   upstream,
+		Downstream: epp.NewConn(c, h.DownstreamOptions...),
+		Proxy:      h.Name,
+		Auth:       h.Auth,
+		Log:        logger,
+		Audit:      h.Audit,
+		Schema:     h.Schema,
+		Policy:     h.Policy,
+		Confirm:    confirmation(c),
+		Session:    id,
 	}
 
-	err = p.Talk()
+	if h.Identities != nil {
+		subject := peerSubject(c)
+		clID, ok := h.Identities[subject]
+		if !ok {
+			p.logger().Warn("client certificate is not mapped to a registrar", "subject", subject)
+		}
+		p.Auth = &identityAuthenticator{next: h.Auth, clID: clID}
+	}
 
-	if err != nil {
-		if _, ok := err.(UpstreamError); ok {
-			upstream.(*pool.PoolConn).MarkUnusable()
-			h.logf("upstream error; downstream=%v, upstream=%v, err=%v", p.Downstream.RemoteAddr(), p.Upstream.RemoteAddr(), err)
-			if nErr, ok := err.(RetryableUpstreamError); ok && h.MaxRetries > 0 {
-				return h.retryFrame(0, p, nErr.failedFrame)
-			}
-		} else if err == io.EOF {
-			h.logf("client disconnected; downstream=%v", p.Downstream.RemoteAddr())
-			return nil
+	if len(h.Accounts) > 0 {
+		p.Route = func(login *epp.Frame) (*epp.Client, *epp.Frame, error) {
+			return h.route(s, login)
 		}
 	}
 
-	return err
+	return h.handleErr(0, s, p, p.Talk(ctx))
 }
 
-func (h *ProxyHandler) retryFrame(retryCount uint8, p *Protocol, frame *epp.Frame) error {
-	if retryCount >= h.MaxRetries {
-		h.logf("max retries reached; count=%d, downstream=%v, cmd=%v", retryCount, p.Downstream.RemoteAddr(), frame.GetCommand())
-		return errors.New("max retries reached")
+// upstream gets an upstream session from the session's pool.
+func (h *ProxyHandler) upstream(s *session) (*epp.Client, error) {
+	upstream, err := s.source.Get()
+
+	if err != nil {
+		return nil, err
 	}
 
-	h.logf("retrying failed frame; downstream=%v, cmd=%v", p.Downstream.RemoteAddr(), frame.GetCommand())
+	s.upstream = upstream
 
-	upstream, err := h.pool.Get()
+	return upstream, nil
+}
 
-	if err != nil {
-		h.logf("retry failed to get new upstream; downstream=%v, err=%v", p.Downstream.RemoteAddr(), err)
-		return err
+// release gives the session's upstream back to its pool.
+func (h *ProxyHandler) release(s *session, healthy bool) {
+	if s.upstream == nil {
+		return
+	}
+
+	if !healthy {
+		upstreamUnusable.With(h.Name).Inc()
 	}
 
-	p.Upstream = epp.NewClient(upstream)
+	s.source.Release(s.upstream, healthy)
+	s.upstream = nil
+}
+
+// route moves the session to the pool of the registry account matching the
+// login's clID and swaps in the account's real credentials, dropping any
+// newPW so a client can't change the account's password. A client without
+// registry credentials of its own still gets its own pool, with the login sent
+// as it is. A clID with no account, which Auth has already refused when
+// clients are configured, stays on the proxy's pool.
+func (h *ProxyHandler) route(s *session, login *epp.Frame) (*epp.Client, *epp.Frame, error) {
+	clID, _ := login.GetLoginCredentials()
+
+	account, ok := h.Accounts[clID]
+	if !ok {
+		return nil, login, nil
+	}
 
-	err = p.Resume(frame)
+	routed := login
 
+	if account.ClID != "" {
+		var err error
+		if routed, err = login.WithLoginCredentials(account.ClID, account.Password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if s.source == account.upstreams {
+		return nil, routed, nil
+	}
+
+	h.release(s, true)
+
+	s.source = account.upstreams
+
+	upstream, err := h.upstream(s)
 	if err != nil {
-		if _, ok := err.(UpstreamError); ok {
-			upstream.(*pool.PoolConn).MarkUnusable()
-			h.logf("upstream error; downstream=%v, upstream=%v, err=%v", p.Downstream.RemoteAddr(), p.Upstream.RemoteAddr(), err)
-			if nErr, ok := err.(RetryableUpstreamError); ok {
-				return h.retryFrame(retryCount+1, p, nErr.failedFrame)
-			}
-		} else if err == io.EOF {
-			h.logf("client disconnected; %v", p.Downstream.RemoteAddr())
-			return nil
+		return nil, nil, err
+	}
+
+	return upstream, routed, nil
+}
+
+// handleErr decides what to do when a Protocol run ends. Upstream failures,
+// timeouts included, throw the upstream session away and count toward
+// MaxRetries; a downstream that disconnects or goes quiet ends the session.
+func (h *ProxyHandler) handleErr(retryCount uint8, s *session, p *Protocol, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// A cancelled session, e.g. one cut off by the proxy stopping, is not
+	// retried. Its upstream session goes back to the pool, which drops it if
+	// the cancellation broke it.
+	if p.ctx.Err() != nil {
+		p.logger().Info("session cancelled", "err", err)
+		return nil
+	}
+
+	if nErr, ok := err.(RetryableUpstreamError); ok {
+		if epp.IsTimeout(nErr.UpstreamError) {
+			p.logger().Warn("upstream timed out", "err", err)
+		} else {
+			p.logger().Warn("upstream error", "err", err)
+		}
+
+		h.release(s, false)
+
+		if h.MaxRetries > 0 {
+			return h.retryFrame(retryCount, s, p, nErr.failedFrame)
 		}
+
+		return err
+	}
+
+	// The HTTP gateway's in-memory pipe reports ErrClosedPipe instead of EOF.
+	if err == io.EOF || err == io.ErrClosedPipe {
+		p.logger().Info("client disconnected")
+		return nil
+	}
+
+	if epp.IsTimeout(err) {
+		p.logger().Info("client timed out", "err", err)
+		return nil
 	}
 
 	return err
 }
+
+func (h *ProxyHandler) retryFrame(retryCount uint8, s *session, p *Protocol, frame *epp.Frame) error {
+	// A nil frame means the failure happened before the greeting.
+	cmd := "greeting"
+	if frame != nil {
+		cmd = frame.GetCommand()
+	}
+
+	if retryCount >= h.MaxRetries {
+		p.logger().Error("max retries reached", "count", retryCount, "cmd", cmd)
+		return errors.New("max retries reached")
+	}
+
+	p.logger().Warn("retrying failed frame", "cmd", cmd)
+	retriesTotal.With(h.Name).Inc()
+
+	upstream, err := h.upstream(s)
+
+	if err != nil {
+		p.logger().Error("retry failed to get new upstream", "err", err)
+		return err
+	}
+
+	p.Upstream = upstream
+
+	return h.handleErr(retryCount+1, s, p, p.Resume(p.ctx, frame))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/pool"
+)
+
+// stubSource hands out the same session every time.
+type stubSource struct {
+	c        *epp.Client
+	released int
+}
+
+func (s *stubSource) Get() (*epp.Client, error)           { return s.c, nil }
+func (s *stubSource) Release(c *epp.Client, healthy bool) { s.released++ }
+func (s *stubSource) Stats() pool.Stats                   { return pool.Stats{} }
+func (s *stubSource) Close()                              {}
+
+// registrySource hands out a session with a registry that answers every
+// command with a 1000 and sends the name of each one it gets on commands.
+func registrySource(t *testing.T) (source *stubSource, commands <-chan string) {
+	upstream, registryEnd := net.Pipe()
+	t.Cleanup(func() { registryEnd.Close() })
+
+	received := make(chan string, 10)
+
+	go func() {
+		registry := epp.NewConn(registryEnd)
+		registry.WriteFrame(epp.FrameFromString(testGreeting))
+
+		for {
+			cmd, err := registry.ReadFrame()
+			if err != nil {
+				return
+			}
+
+			received <- cmd.GetCommand()
+			registry.WriteFrame(registryResponse(cmd.GetClTRID()))
+		}
+	}()
+
+	c := epp.NewClient(upstream, epp.KeepaliveInterval(0), epp.ConnOptions(epp.ReadTimeout(2*time.Second)))
+	t.Cleanup(func() { c.Close() })
+
+	if _, err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed with %v", err)
+	}
+
+	return &stubSource{c: c}, received
+}
+
+func TestCreateAccountsGivesEveryClientAPool(t *testing.T) {
+	p := NewProxy(ProxyConfig{
+		Name: "test",
+		Clients: []ClientConfig{
+			{ClID: "client1", Registry: &AccountConfig{ClID: "REAL", Password: "real", Pool: PoolConfig{MaxOpen: 1}}},
+			{ClID: "client2"},
+		},
+	})
+
+	factory := func() (net.Conn, error) { return nil, errors.New("no registry") }
+
+	accounts, err := p.createAccounts(factory, nil)
+	if err != nil {
+		t.Fatalf("createAccounts failed with %v", err)
+	}
+	defer p.closePools()
+
+	if len(accounts) != 2 {
+		t.Fatalf("Expected an account for each client, got %d", len(accounts))
+	}
+
+	if accounts["client1"].ClID != "REAL" || accounts["client2"].ClID != "" {
+		t.Errorf("Expected only client1 to have registry credentials, got '%s' and '%s'", accounts["client1"].ClID, accounts["client2"].ClID)
+	}
+
+	if accounts["client1"].upstreams == accounts["client2"].upstreams {
+		t.Error("Expected each client to have its own pool")
+	}
+}
+
+func TestCreateAccountsWithoutRegistryAccounts(t *testing.T) {
+	p := NewProxy(ProxyConfig{
+		Name:     "test",
+		Clients:  []ClientConfig{{ClID: "client1"}, {ClID: "client2"}},
+		Upstream: UpstreamConfig{Pool: PoolConfig{MinIdle: 1, MaxOpen: 2}},
+	})
+
+	factory := func() (net.Conn, error) { return nil, errors.New("no registry") }
+
+	accounts, err := p.createAccounts(factory, nil)
+	if err != nil {
+		t.Fatalf("createAccounts failed with %v", err)
+	}
+	defer p.closePools()
+
+	if len(accounts) != 2 {
+		t.Fatalf("Expected an account for each client, got %d", len(accounts))
+	}
+
+	if accounts["client1"].ClID != "" || accounts["client2"].ClID != "" {
+		t.Error("Expected the clients to log in with their own credentials")
+	}
+
+	if accounts["client1"].upstreams == accounts["client2"].upstreams {
+		t.Error("Expected each client to have its own pool rather than sharing one")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	shared := &stubSource{c: &epp.Client{}}
+	account := &stubSource{c: &epp.Client{}}
+	own := &stubSource{c: &epp.Client{}}
+
+	h := &ProxyHandler{Accounts: map[string]*Account{
+		"client1": {ClID: "REAL", Password: "real", upstreams: account},
+		"client2": {upstreams: own},
+	}}
+
+	s := &session{source: shared, upstream: shared.c}
+
+	login := epp.MakeLoginFrame("client2", "secret", "", "CL-1", nil, nil)
+
+	upstream, routed, err := h.route(s, login)
+	if err != nil {
+		t.Fatalf("route failed with %v", err)
+	}
+
+	if upstream != own.c || s.source != own || shared.released != 1 {
+		t.Error("Expected client2 to move to its own pool")
+	}
+
+	if routed != login {
+		t.Error("Expected client2's login to be sent as it is")
+	}
+
+	s = &session{source: shared, upstream: shared.c}
+
+	upstream, routed, err = h.route(s, epp.MakeLoginFrame("client1", "secret", "changed", "CL-2", nil, nil))
+	if err != nil {
+		t.Fatalf("route failed with %v", err)
+	}
+
+	if upstream != account.c || s.source != account {
+		t.Error("Expected client1 to move to its account's pool")
+	}
+
+	if clID, pw := routed.GetLoginCredentials(); clID != "REAL" || pw != "real" {
+		t.Errorf("Expected the account's credentials, got '%s', '%s'", clID, pw)
+	}
+
+	if m, _ := routed.Decode(); m.Command.Login.NewPW != "" {
+		t.Errorf("Expected newPW to be dropped, got '%s'", m.Command.Login.NewPW)
+	}
+}
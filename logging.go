@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return 0, fmt.Errorf("unknown level; level=%s", level)
+}
+
+// newLogger makes the logger everything logs through. Installed as the
+// default it also takes over the log package, whose lines come out at info.
+func newLogger(config LogConfig, w io.Writer) (*slog.Logger, error) {
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	if config.Format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+
+	return slog.New(slog.NewTextHandler(w, options)), nil
+}
+
+// newSessionID returns a random ID that ties together the log lines of one
+// downstream session.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
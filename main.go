@@ -1,65 +1,297 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"log"
-	"net"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/davidrjonas/epplb/rfc5734"
+	"golang.org/x/crypto/bcrypt"
 
-	pool "gopkg.in/fatih/pool.v2"
+	"github.com/davidrjonas/epplb/audit"
 )
 
 var (
+	configFile  = flag.String("config", "", "A YAML config file. Flags that are set override its values.")
+	checkConfig = flag.Bool("check-config", false, "Validate the config and exit without opening any sockets")
+	hashPasswd  = flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the clients config and exit")
+
 	listen   = flag.String("listen", ":10700", "target")
 	upstream = flag.String("upstream", "epp-ote.verisign-grs.com:700", "Upstream to which we should proxy")
 	certFile = flag.String("cert", "crt.pem", "A PEM eoncoded certificate file.")
 	keyFile  = flag.String("key", "key.pem", "A PEM encoded private key file.")
 	caFile   = flag.String("ca", "ca.pem", "A PEM eoncoded CA's certificate file.")
 	maxConns = flag.Int("max-conns", 1, "Maximum number of upstream connections to open")
+	admin    = flag.String("admin", "", "Address for the admin HTTP listener serving /debug/vars and /metrics")
+
+	logFormat = flag.String("log-format", "text", "Log line format, text (logfmt) or json")
+	logLevel  = flag.String("log-level", "info", "Least severe log level written: debug, info, warn or error")
+
+	upstreamReadTimeout    = flag.Duration("upstream-read-timeout", 30*time.Second, "Time allowed to receive the rest of an upstream frame once it starts")
+	upstreamWriteTimeout   = flag.Duration("upstream-write-timeout", 30*time.Second, "Time allowed to send a frame upstream")
+	upstreamIdleTimeout    = flag.Duration("upstream-idle-timeout", 2*time.Minute, "Time allowed for the upstream to start responding")
+	downstreamReadTimeout  = flag.Duration("downstream-read-timeout", 30*time.Second, "Time allowed to receive the rest of a client frame once it starts")
+	downstreamWriteTimeout = flag.Duration("downstream-write-timeout", 30*time.Second, "Time allowed to send a frame to a client")
+	downstreamIdleTimeout  = flag.Duration("downstream-idle-timeout", 5*time.Minute, "Time a client may stay quiet between commands")
 )
 
-func mustCreatePool(capacity int, upstreamHost, certFile, keyFile, caFile string) pool.Pool {
-	upstreams, err := pool.NewChannelPool(1, capacity, NewTlsClientFactory(upstreamHost, certFile, keyFile, caFile))
+// applyFlags copies the flags given on the command line over the config so
+// they take precedence over the file. Timeout flags apply to every proxy, the
+// rest only make sense when there is exactly one.
+func applyFlags(c *Config) error {
+	var err error
 
-	if err != nil {
-		log.Fatalf("Failed to create pool; %v", err)
-	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "admin":
+			c.Admin.Listen = *admin
+			return
+		case "log-format":
+			c.Log.Format = *logFormat
+			return
+		case "log-level":
+			c.Log.Level = *logLevel
+			return
+		}
 
-	return upstreams
+		for i := range c.Proxies {
+			p := &c.Proxies[i]
+
+			switch f.Name {
+			case "listen", "upstream", "cert", "key", "ca", "max-conns":
+				if len(c.Proxies) > 1 {
+					err = fmt.Errorf("flag -%s is ambiguous with %d proxies configured", f.Name, len(c.Proxies))
+					return
+				}
+			}
+
+			switch f.Name {
+			case "listen":
+				p.Listen = *listen
+			case "upstream":
+				p.Upstream.Address = *upstream
+				p.Upstream.Endpoints = nil
+			case "cert":
+				p.Upstream.TLS.Cert = *certFile
+			case "key":
+				p.Upstream.TLS.Key = *keyFile
+			case "ca":
+				p.Upstream.TLS.CA = *caFile
+			case "max-conns":
+				p.Upstream.Pool.MaxOpen = *maxConns
+				if p.Upstream.Pool.MinIdle > *maxConns {
+					p.Upstream.Pool.MinIdle = *maxConns
+				}
+			case "upstream-read-timeout":
+				p.Upstream.Timeouts.Read = Duration(*upstreamReadTimeout)
+			case "upstream-write-timeout":
+				p.Upstream.Timeouts.Write = Duration(*upstreamWriteTimeout)
+			case "upstream-idle-timeout":
+				p.Upstream.Timeouts.Idle = Duration(*upstreamIdleTimeout)
+			case "downstream-read-timeout":
+				p.Downstream.Timeouts.Read = Duration(*downstreamReadTimeout)
+			case "downstream-write-timeout":
+				p.Downstream.Timeouts.Write = Duration(*downstreamWriteTimeout)
+			case "downstream-idle-timeout":
+				p.Downstream.Timeouts.Idle = Duration(*downstreamIdleTimeout)
+			}
+		}
+	})
+
+	return err
 }
 
-func mustListen(laddr string) net.Listener {
-	server, err := net.Listen("tcp", laddr)
+func printPasswordHash() {
+	pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		log.Fatalf("Failed to read password; %v", err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(pw, "\r\n")), bcrypt.DefaultCost)
 
 	if err != nil {
-		log.Fatalf("Failed to listen; address=%s, err=%v", laddr, err)
+		log.Fatalf("Failed to hash password; %v", err)
 	}
 
-	return server
+	fmt.Println(string(hash))
 }
 
-func NewEppServer(laddr string, maxConns int, upstreamHost, certFile, keyFile, caFile string) *rfc5734.Server {
-	h := ProxyHandler{pool: mustCreatePool(maxConns, upstreamHost, certFile, keyFile, caFile), MaxRetries: 3}
-	s := rfc5734.NewServer(mustListen(laddr))
+// openAudit opens the audit log's file or syslog connection.
+func openAudit(c *AuditConfig) (*audit.Log, error) {
+	if c.File != nil {
+		f, err := audit.OpenFile(c.File.Path, int64(c.File.MaxSizeMB)<<20, c.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return audit.New(f), nil
+	}
+
+	tag := c.Syslog.Tag
+	if tag == "" {
+		tag = "epplb"
+	}
 
-	go s.Serve(h.Handle)
+	w, err := audit.DialSyslog(c.Syslog.Network, c.Syslog.Address, tag)
+	if err != nil {
+		return nil, err
+	}
 
-	return s
+	return audit.New(w), nil
 }
 
 func main() {
 	flag.Parse()
 
-	s := NewEppServer(*listen, *maxConns, *upstream, *certFile, *keyFile, *caFile)
+	if *hashPasswd {
+		printPasswordHash()
+		return
+	}
+
+	config, err := LoadConfig(*configFile)
+
+	if err != nil {
+		log.Fatalf("Failed to load config; %v", err)
+	}
+
+	if err := applyFlags(config); err != nil {
+		log.Fatalf("Invalid flags; %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config; %v", err)
+	}
+
+	logger, err := newLogger(config.Log, os.Stderr)
+	if err != nil {
+		log.Fatalf("Invalid config; %v", err)
+	}
+
+	slog.SetDefault(logger)
+
+	if *checkConfig {
+		log.Println("Config is valid")
+		return
+	}
+
+	var auditLog *audit.Log
+
+	if config.Audit != nil {
+		if auditLog, err = openAudit(config.Audit); err != nil {
+			log.Fatalf("Failed to open audit log; %v", err)
+		}
+	}
+
+	proxies := make([]*Proxy, len(config.Proxies))
+
+	for i, pc := range config.Proxies {
+		proxies[i] = NewProxy(pc)
+		proxies[i].Audit = auditLog
+	}
+
+	var adminServer *AdminServer
+
+	if config.Admin.Listen != "" {
+		adminServer = NewAdminServer(config.Admin.Listen, proxies)
+
+		if err := adminServer.Start(); err != nil {
+			log.Fatalf("Failed to start admin server; %v", err)
+		}
+	}
+
+	for i, p := range proxies {
+		if err := p.Start(); err != nil {
+			stopProxies(proxies[:i])
+			log.Fatalf("Failed to start proxy; name=%s, err=%v", p.Name, err)
+		}
+	}
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-sigs
+	sig := <-sigs
+
+	for sig == syscall.SIGHUP {
+		reloadPolicies(proxies)
+		sig = <-sigs
+	}
+
+	slog.Info("shutting down", "signal", sig.String())
+
+	stopProxies(proxies)
+
+	if adminServer != nil {
+		adminServer.Stop()
+	}
+
+	if auditLog != nil {
+		auditLog.Close()
+	}
+}
+
+// reloadPolicies reads the config file again and swaps in each proxy's
+// policy rules. Nothing else in the file is reloaded, and a config that
+// isn't valid leaves every policy as it was.
+func reloadPolicies(proxies []*Proxy) {
+	config, err := LoadConfig(*configFile)
+	if err == nil {
+		err = applyFlags(config)
+	}
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		slog.Error("failed to reload config", "err", err)
+		return
+	}
+
+	for _, p := range proxies {
+		var pc *ProxyConfig
+		for i := range config.Proxies {
+			if config.Proxies[i].Name == p.Name {
+				pc = &config.Proxies[i]
+			}
+		}
+
+		if pc == nil {
+			slog.Warn("proxy no longer in config, keeping its policy", "proxy", p.Name)
+			continue
+		}
+
+		if err := p.ReloadPolicy(pc.Policy); err != nil {
+			slog.Error("failed to reload policy", "proxy", p.Name, "err", err)
+			continue
+		}
+
+		rules := 0
+		if pc.Policy != nil {
+			rules = len(pc.Policy.Rules)
+		}
+
+		slog.Info("policy reloaded", "proxy", p.Name, "rules", rules)
+	}
+}
+
+// stopProxies stops all proxies at once so that one with long-lived clients
+// doesn't hold up the others.
+func stopProxies(proxies []*Proxy) {
+	var wg sync.WaitGroup
+
+	for _, p := range proxies {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.Stop()
+		}(p)
+	}
 
-	log.Println("Closing listener and waiting for clients to finish")
-	s.Stop()
+	wg.Wait()
 }
@@ -0,0 +1,340 @@
+// Package metrics provides counters and histograms that are published both
+// through expvar and in the Prometheus text exposition format.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	writePrometheus(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(name string, m metric, v expvar.Var) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = append(registry, m)
+	expvar.Publish(name, v)
+}
+
+// DefaultBuckets are histogram buckets, in seconds, suited to registry round
+// trips.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// labelString renders label pairs as {a="1",b="2"}, adding extra pairs after
+// the metric's own.
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// expvarKey renders label values as a=1,b=2 for the expvar JSON.
+func (d *desc) expvarKey(values []string) string {
+	pairs := make([]string, len(d.labels))
+	for i, label := range d.labels {
+		pairs[i] = label + "=" + values[i]
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	mu       sync.Mutex
+	counters map[string]*Counter
+	values   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		desc:     desc{name: name, help: help, labels: labels},
+		counters: make(map[string]*Counter),
+		values:   make(map[string][]string),
+	}
+
+	register(name, v, expvar.Func(v.expvar))
+
+	return v
+}
+
+// With returns the counter for the given label values, in the order the
+// labels were declared.
+func (v *CounterVec) With(values ...string) *Counter {
+	key := v.key(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+
+	return c
+}
+
+func (v *CounterVec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (v *CounterVec) expvar() interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	out := make(map[string]uint64, len(v.counters))
+	for key, c := range v.counters {
+		out[v.expvarKey(v.values[key])] = c.Value()
+	}
+
+	return out
+}
+
+func (v *CounterVec) writePrometheus(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w, "counter")
+
+	for _, key := range v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, v.labelString(v.values[key]), v.counters[key].Value())
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+type histogramSnapshot struct {
+	Buckets map[string]uint64 `json:"buckets"`
+	Sum     float64           `json:"sum"`
+	Count   uint64            `json:"count"`
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := histogramSnapshot{
+		Buckets: make(map[string]uint64, len(h.buckets)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+
+	for i, upper := range h.buckets {
+		s.Buckets[formatFloat(upper)] = h.counts[i]
+	}
+
+	return s
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+	values     map[string][]string
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	v := &HistogramVec{
+		desc:       desc{name: name, help: help, labels: labels},
+		buckets:    sorted,
+		histograms: make(map[string]*Histogram),
+		values:     make(map[string][]string),
+	}
+
+	register(name, v, expvar.Func(v.expvar))
+
+	return v
+}
+
+// With returns the histogram for the given label values, in the order the
+// labels were declared.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := v.key(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.histograms[key] = h
+		v.values[key] = append([]string(nil), values...)
+	}
+
+	return h
+}
+
+func (v *HistogramVec) expvar() interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	out := make(map[string]histogramSnapshot, len(v.histograms))
+	for key, h := range v.histograms {
+		out[v.expvarKey(v.values[key])] = h.snapshot()
+	}
+
+	return out
+}
+
+func (v *HistogramVec) writePrometheus(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w, "histogram")
+
+	keys := make([]string, 0, len(v.histograms))
+	for key := range v.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := v.values[key]
+		s := v.histograms[key].snapshot()
+
+		for _, upper := range v.buckets {
+			le := formatFloat(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, "le", le), s.Buckets[le])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, "le", "+Inf"), s.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelString(values), formatFloat(s.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelString(values), s.Count)
+	}
+}
+
+// WritePrometheus writes every registered metric in the Prometheus text
+// exposition format.
+func WritePrometheus(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		m.writePrometheus(w)
+	}
+}
+
+// Handler serves WritePrometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
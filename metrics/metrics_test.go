@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var runs int
+
+// uniqueName gives each run of a test, as with -count, a metric name of its
+// own, since a name can only be published once.
+func uniqueName(name string) string {
+	runs++
+	return fmt.Sprintf("%s_%d", name, runs)
+}
+
+func TestCounterVecPrometheus(t *testing.T) {
+	name := uniqueName("test_commands_total")
+	v := NewCounterVec(name, "Commands by type.", "proxy", "command")
+	v.With("a", "check").Inc()
+	v.With("a", "check").Inc()
+	v.With("a", `in"fo`).Add(3)
+
+	var buf bytes.Buffer
+	v.writePrometheus(&buf)
+
+	expected := "# HELP " + name + " Commands by type.\n" +
+		"# TYPE " + name + " counter\n" +
+		name + `{proxy="a",command="check"} 2` + "\n" +
+		name + `{proxy="a",command="in\"fo"} 3` + "\n"
+
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestCounterVecExpvar(t *testing.T) {
+	name := uniqueName("test_expvar_total")
+	v := NewCounterVec(name, "", "proxy")
+	v.With("a").Inc()
+
+	var out map[string]uint64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &out); err != nil {
+		t.Fatalf("Failed to decode expvar: %v", err)
+	}
+
+	if out["proxy=a"] != 1 {
+		t.Errorf("Expected 1, got %v", out)
+	}
+}
+
+func TestHistogramVecPrometheus(t *testing.T) {
+	name := uniqueName("test_latency_seconds")
+	v := NewHistogramVec(name, "Latency.", []float64{1, 0.5}, "proxy")
+	h := v.With("a")
+	h.Observe(0.25)
+	h.Observe(0.75)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	v.writePrometheus(&buf)
+
+	for _, line := range []string{
+		name + `_bucket{proxy="a",le="0.5"} 1`,
+		name + `_bucket{proxy="a",le="1"} 2`,
+		name + `_bucket{proxy="a",le="+Inf"} 3`,
+		name + `_sum{proxy="a"} 3`,
+		name + `_count{proxy="a"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected line %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestWithPanicsOnWrongLabelCount(t *testing.T) {
+	v := NewCounterVec(uniqueName("test_labels_total"), "", "proxy")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic")
+		}
+	}()
+
+	v.With("a", "b")
+}
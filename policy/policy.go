@@ -0,0 +1,319 @@
+// Package policy decides whether a client may send a command, by the first
+// of a list of rules that matches it.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+
+	// Confirm allows a command only if the client confirmed it, and denies
+	// it otherwise.
+	Confirm Action = "confirm"
+)
+
+// Rule matches a command when each of its conditions does. A condition left
+// empty matches anything. Code and Message are the result a denied command
+// gets, 2201 "Authorization error" if not given.
+type Rule struct {
+	// Clients are clIDs, as given at login.
+	Clients []string
+
+	// Commands are command names such as delete or transfer.
+	Commands []string
+
+	// Objects are object namespaces, or short names such as domain for
+	// urn:ietf:params:xml:ns:domain-1.0.
+	Objects []string
+
+	// TLDs match the names of the objects a command acts on by suffix, so
+	// co.uk matches example.co.uk.
+	TLDs []string
+
+	// Extensions are extension namespaces, any of which the command uses.
+	Extensions []string
+
+	Action  Action
+	Code    uint16
+	Message string
+}
+
+// Request is a command to decide on.
+type Request struct {
+	ClID      string
+	Command   string
+	ObjURI    string
+	Names     []string
+	ExtURIs   []string
+	Confirmed bool
+}
+
+// Decision is what a Policy decided about a command. Rule is the index of
+// the rule that decided it, or -1 if none matched.
+type Decision struct {
+	Allowed bool
+	Code    uint16
+	Message string
+	Rule    int
+}
+
+// Policy is a list of rules and the action for commands none of them match.
+// It is safe for concurrent use and its rules can be replaced while in use.
+type Policy struct {
+	mu            sync.RWMutex
+	rules         []Rule
+	defaultAction Action
+}
+
+// New makes a Policy, checking the rules and filling in their default codes
+// and messages. An empty defaultAction is Allow.
+func New(rules []Rule, defaultAction Action) (*Policy, error) {
+	p := &Policy{}
+
+	if err := p.Update(rules, defaultAction); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Update replaces the rules. Commands decided after it returns use the new
+// ones. On error the old rules are kept.
+func (p *Policy) Update(rules []Rule, defaultAction Action) error {
+	switch defaultAction {
+	case "":
+		defaultAction = Allow
+	case Allow, Deny:
+	default:
+		return fmt.Errorf("default must be allow or deny; default=%s", defaultAction)
+	}
+
+	checked := make([]Rule, len(rules))
+
+	for i, r := range rules {
+		if err := check(&r); err != nil {
+			return fmt.Errorf("rules[%d]: %v", i, err)
+		}
+		checked[i] = r
+	}
+
+	p.mu.Lock()
+	p.rules = checked
+	p.defaultAction = defaultAction
+	p.mu.Unlock()
+
+	return nil
+}
+
+func check(r *Rule) error {
+	for _, c := range r.Commands {
+		if !contains(commands, c) {
+			return fmt.Errorf("unknown command; command=%s", c)
+		}
+	}
+
+	// Other objects are given by namespace.
+	for _, o := range r.Objects {
+		if !contains(objects, o) && !strings.Contains(o, ":") {
+			return fmt.Errorf("unknown object; object=%s", o)
+		}
+	}
+
+	switch r.Action {
+	case Allow:
+		if r.Code != 0 || r.Message != "" {
+			return errors.New("code and message are only for deny and confirm")
+		}
+		return nil
+	case Deny, Confirm:
+	case "":
+		return errors.New("action is required")
+	default:
+		return fmt.Errorf("unknown action; action=%s", r.Action)
+	}
+
+	if r.Code == 0 {
+		r.Code = 2201
+	}
+
+	// 25xx codes say the server is closing the connection, which the proxy
+	// doesn't do.
+	if r.Code < 2000 || r.Code > 2499 {
+		return fmt.Errorf("code must be an error code from 2000 to 2499; code=%d", r.Code)
+	}
+
+	if r.Message == "" && resultMessages[r.Code] != "" {
+		r.Message = resultMessages[r.Code]
+		if r.Action == Confirm {
+			r.Message += "; confirmation required"
+		}
+	}
+
+	if r.Message == "" {
+		return fmt.Errorf("message is required for code %d", r.Code)
+	}
+
+	return nil
+}
+
+// Decide runs a command past the rules. A command for several objects, such
+// as a check, is decided for each of them and denied if any one is.
+func (p *Policy) Decide(r Request) Decision {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := r.Names
+	if len(names) == 0 {
+		names = []string{""}
+	}
+
+	var allowed *Decision
+
+	for _, name := range names {
+		d := p.decide(r, name)
+		if !d.Allowed {
+			return d
+		}
+
+		if allowed == nil {
+			allowed = &d
+		}
+	}
+
+	return *allowed
+}
+
+func (p *Policy) decide(r Request, name string) Decision {
+	for i, rule := range p.rules {
+		if !rule.matches(r, name) {
+			continue
+		}
+
+		if rule.Action == Allow || rule.Action == Confirm && r.Confirmed {
+			return Decision{Allowed: true, Rule: i}
+		}
+
+		return Decision{Code: rule.Code, Message: rule.Message, Rule: i}
+	}
+
+	if p.defaultAction == Deny {
+		return Decision{Code: 2201, Message: resultMessages[2201], Rule: -1}
+	}
+
+	return Decision{Allowed: true, Rule: -1}
+}
+
+func (rule *Rule) matches(r Request, name string) bool {
+	if len(rule.Clients) > 0 && !contains(rule.Clients, r.ClID) {
+		return false
+	}
+
+	if len(rule.Commands) > 0 && !contains(rule.Commands, r.Command) {
+		return false
+	}
+
+	if len(rule.Objects) > 0 && (r.ObjURI == "" || !contains(rule.Objects, r.ObjURI) && !contains(rule.Objects, objectType(r.ObjURI))) {
+		return false
+	}
+
+	if len(rule.TLDs) > 0 && !inTLDs(name, rule.TLDs) {
+		return false
+	}
+
+	if len(rule.Extensions) > 0 && !containsAny(rule.Extensions, r.ExtURIs) {
+		return false
+	}
+
+	return true
+}
+
+// objectType turns an object namespace into its short name, e.g.
+// urn:ietf:params:xml:ns:domain-1.0 into domain.
+func objectType(uri string) string {
+	t := strings.TrimPrefix(uri, "urn:ietf:params:xml:ns:")
+
+	if i := strings.LastIndex(t, "-"); i > 0 {
+		t = t[:i]
+	}
+
+	return t
+}
+
+func inTLDs(name string, tlds []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for _, tld := range tlds {
+		tld = strings.ToLower(strings.Trim(tld, "."))
+		if strings.HasSuffix(name, "."+tld) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		if contains(list, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commands are the RFC 5730 commands a policy decides. Login and logout are
+// answered before any rule is consulted.
+var commands = []string{"check", "create", "delete", "info", "poll", "renew", "transfer", "update"}
+
+// objects are the short names of the RFC 5731 to 5733 objects.
+var objects = []string{"domain", "host", "contact"}
+
+// resultMessages are the messages RFC 5730 gives for its error codes, short
+// of those that close the connection.
+var resultMessages = map[uint16]string{
+	2000: "Unknown command",
+	2001: "Command syntax error",
+	2002: "Command use error",
+	2003: "Required parameter missing",
+	2004: "Parameter value range error",
+	2005: "Parameter value syntax error",
+	2100: "Unimplemented protocol version",
+	2101: "Unimplemented command",
+	2102: "Unimplemented option",
+	2103: "Unimplemented extension",
+	2104: "Billing failure",
+	2105: "Object is not eligible for renewal",
+	2106: "Object is not eligible for transfer",
+	2200: "Authentication error",
+	2201: "Authorization error",
+	2202: "Invalid authorization information",
+	2300: "Object pending transfer",
+	2301: "Object not pending transfer",
+	2302: "Object exists",
+	2303: "Object does not exist",
+	2304: "Object status prohibits operation",
+	2305: "Object association prohibits operation",
+	2306: "Parameter value policy error",
+	2307: "Unimplemented object service",
+	2308: "Data management policy violation",
+	2400: "Command failed",
+}
@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+const nsDomain = "urn:ietf:params:xml:ns:domain-1.0"
+
+func mustNew(t *testing.T, rules []Rule, defaultAction Action) *Policy {
+	p, err := New(rules, defaultAction)
+	if err != nil {
+		t.Fatalf("New failed with %v", err)
+	}
+
+	return p
+}
+
+func TestDecideFirstMatchWins(t *testing.T) {
+	p := mustNew(t, []Rule{
+		{Clients: []string{"admin"}, Action: Allow},
+		{Commands: []string{"delete", "transfer"}, Objects: []string{"domain"}, Action: Deny, Code: 2304, Message: "Deletes are disabled"},
+	}, "")
+
+	d := p.Decide(Request{ClID: "client1", Command: "delete", ObjURI: nsDomain, Names: []string{"example.com"}})
+	if d.Allowed || d.Code != 2304 || d.Message != "Deletes are disabled" || d.Rule != 1 {
+		t.Errorf("Expected rule 1 to deny with 2304, got %+v", d)
+	}
+
+	d = p.Decide(Request{ClID: "admin", Command: "delete", ObjURI: nsDomain, Names: []string{"example.com"}})
+	if !d.Allowed || d.Rule != 0 {
+		t.Errorf("Expected rule 0 to allow admin, got %+v", d)
+	}
+
+	d = p.Decide(Request{ClID: "client1", Command: "delete", ObjURI: "urn:ietf:params:xml:ns:host-1.0", Names: []string{"ns1.example.com"}})
+	if !d.Allowed || d.Rule != -1 {
+		t.Errorf("Expected a host delete to fall through to the default, got %+v", d)
+	}
+}
+
+func TestDecideDefaultDeny(t *testing.T) {
+	p := mustNew(t, []Rule{{Commands: []string{"check", "info", "poll"}, Action: Allow}}, Deny)
+
+	if d := p.Decide(Request{Command: "poll"}); !d.Allowed {
+		t.Errorf("Expected poll to be allowed, got %+v", d)
+	}
+
+	d := p.Decide(Request{Command: "create", ObjURI: nsDomain, Names: []string{"example.com"}})
+	if d.Allowed || d.Code != 2201 || d.Message != "Authorization error" || d.Rule != -1 {
+		t.Errorf("Expected the default to deny with 2201, got %+v", d)
+	}
+}
+
+func TestDecideTLDs(t *testing.T) {
+	p := mustNew(t, []Rule{{TLDs: []string{".co.uk", "NET"}, Action: Deny}}, "")
+
+	for name, allowed := range map[string]bool{
+		"example.co.uk":  false,
+		"EXAMPLE.NET.":   false,
+		"example.com":    true,
+		"co.uk":          true,
+		"examplenet.com": true,
+	} {
+		d := p.Decide(Request{Command: "info", ObjURI: nsDomain, Names: []string{name}})
+		if d.Allowed != allowed {
+			t.Errorf("Expected %s allowed=%v, got %+v", name, allowed, d)
+		}
+	}
+
+	d := p.Decide(Request{Command: "check", ObjURI: nsDomain, Names: []string{"a.com", "b.net"}})
+	if d.Allowed {
+		t.Errorf("Expected a check with one denied name to be denied, got %+v", d)
+	}
+
+	if d := p.Decide(Request{Command: "poll"}); !d.Allowed {
+		t.Errorf("Expected a command without names not to match a TLD rule, got %+v", d)
+	}
+}
+
+func TestDecideExtensions(t *testing.T) {
+	p := mustNew(t, []Rule{{Extensions: []string{"urn:ietf:params:xml:ns:rgp-1.0"}, Action: Deny}}, "")
+
+	d := p.Decide(Request{Command: "update", ObjURI: nsDomain, ExtURIs: []string{"urn:ietf:params:xml:ns:secDNS-1.1", "urn:ietf:params:xml:ns:rgp-1.0"}})
+	if d.Allowed {
+		t.Errorf("Expected a restore to be denied, got %+v", d)
+	}
+
+	if d := p.Decide(Request{Command: "update", ObjURI: nsDomain}); !d.Allowed {
+		t.Errorf("Expected an update without rgp to be allowed, got %+v", d)
+	}
+}
+
+func TestDecideConfirm(t *testing.T) {
+	p := mustNew(t, []Rule{{Commands: []string{"delete"}, Action: Confirm}}, "")
+
+	d := p.Decide(Request{Command: "delete", ObjURI: nsDomain, Names: []string{"example.com"}})
+	if d.Allowed || d.Code != 2201 || !strings.Contains(d.Message, "confirmation required") {
+		t.Errorf("Expected an unconfirmed delete to be denied, got %+v", d)
+	}
+
+	d = p.Decide(Request{Command: "delete", ObjURI: nsDomain, Names: []string{"example.com"}, Confirmed: true})
+	if !d.Allowed || d.Rule != 0 {
+		t.Errorf("Expected a confirmed delete to be allowed, got %+v", d)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	p := mustNew(t, nil, "")
+
+	req := Request{Command: "delete", ObjURI: nsDomain, Names: []string{"example.com"}}
+
+	if d := p.Decide(req); !d.Allowed {
+		t.Errorf("Expected an empty policy to allow, got %+v", d)
+	}
+
+	if err := p.Update([]Rule{{Commands: []string{"delete"}, Action: Deny}}, ""); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+
+	if d := p.Decide(req); d.Allowed {
+		t.Errorf("Expected the new rule to deny, got %+v", d)
+	}
+
+	if err := p.Update([]Rule{{Action: "maybe"}}, ""); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+
+	if err := p.Update([]Rule{{Commands: []string{"dlete"}, Action: Allow}}, ""); err == nil {
+		t.Error("Expected an error for an unknown command")
+	}
+
+	if d := p.Decide(req); d.Allowed {
+		t.Errorf("Expected a failed update to keep the old rules, got %+v", d)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, tc := range []struct {
+		rules         []Rule
+		defaultAction Action
+		err           string
+	}{
+		{nil, Confirm, "default must be allow or deny"},
+		{[]Rule{{}}, "", "rules[0]: action is required"},
+		{[]Rule{{Action: Deny, Code: 1000}}, "", "code must be an error code"},
+		{[]Rule{{Action: Deny, Code: 2500}}, "", "code must be an error code"},
+		{[]Rule{{Action: Deny, Code: 2399}}, "", "message is required"},
+		{[]Rule{{Action: Allow, Code: 2201}}, "", "only for deny and confirm"},
+		{[]Rule{{Commands: []string{"delete", "remove"}, Action: Deny}}, "", "unknown command; command=remove"},
+		{[]Rule{{Commands: []string{"login"}, Action: Deny}}, "", "unknown command; command=login"},
+		{[]Rule{{Objects: []string{"domains"}, Action: Allow}}, "", "unknown object; object=domains"},
+	} {
+		_, err := New(tc.rules, tc.defaultAction)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected an error containing '%s', got %v", tc.err, err)
+		}
+	}
+}
+
+func TestNewAcceptsObjectNamespaces(t *testing.T) {
+	p := mustNew(t, []Rule{{Objects: []string{"urn:example:registrant-1.0"}, Action: Deny}}, "")
+
+	if d := p.Decide(Request{Command: "info", ObjURI: "urn:example:registrant-1.0"}); d.Allowed {
+		t.Errorf("Expected a rule naming an object namespace to match it, got %+v", d)
+	}
+}
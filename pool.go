@@ -3,35 +3,32 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
-	"log"
-	"net"
 )
 
-func NewTlsClientFactory(address, certFile, keyFile, caFile string) func() (net.Conn, error) {
+func loadTlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 
 	if err != nil {
-		log.Fatalf("Failed to load cert and key; certFile=%s, keyFile=%s, err=%v", certFile, keyFile, err)
+		return nil, fmt.Errorf("failed to load cert and key; certFile=%s, keyFile=%s, err=%v", certFile, keyFile, err)
 	}
 
 	caCert, err := ioutil.ReadFile(caFile)
 
 	if err != nil {
-		log.Fatalf("Failed to load ca file; caFile=%s, err=%v", caFile, err)
+		return nil, fmt.Errorf("failed to load ca file; caFile=%s, err=%v", caFile, err)
 	}
 
 	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in ca file; caFile=%s", caFile)
+	}
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		RootCAs:      caCertPool,
 	}
 
-	tlsConfig.BuildNameToCertificate()
-
-	return func() (net.Conn, error) {
-		return tls.Dial("tcp", address, tlsConfig)
-	}
+	return tlsConfig, nil
 }
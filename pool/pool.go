@@ -0,0 +1,524 @@
+// Package pool keeps upstream EPP sessions open between downstream clients.
+// Unlike a pool of raw connections it stores epp.Clients, so a session's
+// greeting, login and keepalive survive from one borrower to the next.
+package pool
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+var (
+	// ErrClosed is returned by Get once the pool has been closed.
+	ErrClosed = errors.New("pool: closed")
+
+	// ErrTimeout is returned by Get when no session became available within
+	// the wait timeout.
+	ErrTimeout = errors.New("pool: timed out waiting for a session")
+)
+
+// Dialer opens a new session. It should return it greeted, so the pool only
+// ever holds sessions that are known to work.
+type Dialer func() (*epp.Client, error)
+
+// Checker tests that an idle session still works, e.g. by sending a hello.
+type Checker func(*epp.Client) error
+
+// Stats is a snapshot of a pool's sessions and health. LastError is from the
+// latest failed health check or dial and is cleared by the next success.
+type Stats struct {
+	Open      int
+	Idle      int
+	Waiting   int
+	Checks    uint64
+	Failures  uint64
+	LastCheck time.Time
+	LastError string
+}
+
+// handoff is what a waiting Get receives: a session, permission to dial one
+// or an error.
+type handoff struct {
+	client *epp.Client
+	err    error
+}
+
+type Pool struct {
+	dial        Dialer
+	minIdle     int
+	maxOpen     int
+	waitTimeout time.Duration
+
+	checkInterval time.Duration
+	check         Checker
+
+	logoutTimeout time.Duration
+
+	log *slog.Logger
+
+	mu      sync.Mutex
+	idle    []*epp.Client
+	open    int
+	waiters []chan handoff
+	filling bool
+	closed  bool
+	done    chan struct{}
+	health  Stats
+}
+
+type Option func(*Pool)
+
+// MinIdle is how many idle sessions the pool keeps open. They are dialled by
+// New and replaced in the background when sessions are discarded.
+func MinIdle(n int) Option {
+	return func(p *Pool) {
+		p.minIdle = n
+	}
+}
+
+// MaxOpen limits the sessions open at once, idle and borrowed. Zero means
+// no limit.
+func MaxOpen(n int) Option {
+	return func(p *Pool) {
+		p.maxOpen = n
+	}
+}
+
+// WaitTimeout limits how long Get waits for a session when MaxOpen are
+// already open. Zero means wait as long as it takes.
+func WaitTimeout(d time.Duration) Option {
+	return func(p *Pool) {
+		p.waitTimeout = d
+	}
+}
+
+// HealthCheck runs check on each idle session every interval. Sessions that
+// fail are closed and replaced in the background by a new session, logged in
+// with the same login as the one it replaces.
+func HealthCheck(interval time.Duration, check Checker) Option {
+	return func(p *Pool) {
+		p.checkInterval = interval
+		p.check = check
+	}
+}
+
+// LogoutTimeout limits how long Close waits for each logged in session's
+// logout to be answered. It defaults to five seconds.
+func LogoutTimeout(d time.Duration) Option {
+	return func(p *Pool) {
+		p.logoutTimeout = d
+	}
+}
+
+// Logger is where the pool logs sessions it evicts and fails to dial. It
+// defaults to slog's default logger.
+func Logger(l *slog.Logger) Option {
+	return func(p *Pool) {
+		p.log = l
+	}
+}
+
+// New makes a pool and dials its MinIdle sessions.
+func New(dial Dialer, options ...Option) (*Pool, error) {
+	p := &Pool{dial: dial, done: make(chan struct{}), logoutTimeout: 5 * time.Second, log: slog.Default()}
+
+	for _, opt := range options {
+		opt(p)
+	}
+
+	if p.maxOpen > 0 && p.minIdle > p.maxOpen {
+		return nil, errors.New("pool: min idle is more than max open")
+	}
+
+	for i := 0; i < p.minIdle; i++ {
+		c, err := p.dialWatched()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.open++
+		p.idle = append(p.idle, c)
+	}
+
+	if p.checkInterval > 0 && p.check != nil {
+		go p.checkLoop()
+	}
+
+	return p, nil
+}
+
+// Get borrows a session, dialling one if none is idle and fewer than MaxOpen
+// are open, and otherwise waiting for one to be returned. The session must be
+// given back with Put or Discard.
+func (p *Pool) Get() (*epp.Client, error) {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		// Idle sessions can still be broken by a failed keepalive.
+		if c.Err() != nil {
+			p.open--
+			c.Close()
+			continue
+		}
+
+		p.mu.Unlock()
+		return c, nil
+	}
+
+	if p.maxOpen <= 0 || p.open < p.maxOpen {
+		p.open++
+		p.mu.Unlock()
+		return p.dialOpen()
+	}
+
+	ch := make(chan handoff, 1)
+	p.waiters = append(p.waiters, ch)
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case h := <-ch:
+		return p.received(h)
+	case <-timeout:
+	}
+
+	p.mu.Lock()
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mu.Unlock()
+			return nil, ErrTimeout
+		}
+	}
+	p.mu.Unlock()
+
+	// Something was handed over just as the timer fired.
+	return p.received(<-ch)
+}
+
+func (p *Pool) received(h handoff) (*epp.Client, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	if h.client == nil {
+		return p.dialOpen()
+	}
+
+	return h.client, nil
+}
+
+// dialOpen dials a session for a slot that has already been counted as open.
+func (p *Pool) dialOpen() (*epp.Client, error) {
+	c, err := p.dialWatched()
+	p.record(err)
+
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// record notes the outcome of a dial or health check.
+func (p *Pool) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.health.LastError = err.Error()
+	} else {
+		p.health.LastError = ""
+	}
+}
+
+// Put returns a session to the pool. Only sessions in a known state are
+// kept: logged in, or only greeted, with nothing in flight and no failure.
+// Anything else, such as a session whose login was refused, is discarded.
+func (p *Pool) Put(c *epp.Client) {
+	if c.Err() != nil || c.Pending() > 0 || !(c.LoggedIn() || c.Fresh()) {
+		p.Discard(c)
+		return
+	}
+
+	p.put(c)
+}
+
+func (p *Pool) put(c *epp.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		p.open--
+		go p.shutdown(c)
+		return
+	}
+
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- handoff{client: c}
+		return
+	}
+
+	p.idle = append(p.idle, c)
+}
+
+// Discard closes a borrowed session instead of returning it.
+func (p *Pool) Discard(c *epp.Client) {
+	c.Close()
+	p.release()
+	go p.fill()
+}
+
+// release frees an open slot, handing it to the oldest waiter if there is
+// one.
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.waiters) > 0 && !p.closed {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- handoff{}
+		return
+	}
+
+	p.open--
+}
+
+// dialWatched dials a session and watches it for as long as it is open.
+func (p *Pool) dialWatched() (*epp.Client, error) {
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.watch(c)
+
+	return c, nil
+}
+
+// watch replaces a session that breaks while idle, for instance on a failed
+// keepalive, without waiting for a Get or health check to find it. Sessions
+// that break while borrowed are discarded when they are returned.
+func (p *Pool) watch(c *epp.Client) {
+	<-c.Done()
+
+	err := c.Err()
+	if err == nil {
+		return
+	}
+
+	p.mu.Lock()
+	for i, idle := range p.idle {
+		if idle == c {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			p.mu.Unlock()
+
+			p.record(err)
+			p.log.Warn("evicting idle session that broke", "upstream", c.RemoteAddr().String(), "err", err)
+			p.replace(c)
+			return
+		}
+	}
+	p.mu.Unlock()
+}
+
+// fill dials sessions until MinIdle are idle or MaxOpen are open.
+func (p *Pool) fill() {
+	p.mu.Lock()
+	if p.filling {
+		p.mu.Unlock()
+		return
+	}
+	p.filling = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.filling = false
+		p.mu.Unlock()
+	}()
+
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle) >= p.minIdle || (p.maxOpen > 0 && p.open >= p.maxOpen) {
+			p.mu.Unlock()
+			return
+		}
+		p.open++
+		p.mu.Unlock()
+
+		c, err := p.dialWatched()
+		p.record(err)
+
+		if err != nil {
+			p.log.Error("failed to refill pool", "err", err)
+			p.release()
+			return
+		}
+
+		p.put(c)
+	}
+}
+
+func (p *Pool) checkLoop() {
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+// checkIdle checks each session that is idle when it starts, one at a time,
+// taking it out of the pool while it is being checked.
+func (p *Pool) checkIdle() {
+	p.mu.Lock()
+	n := len(p.idle)
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		p.mu.Lock()
+		if p.closed || len(p.idle) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		// The oldest session is at the front; Get takes from the back.
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+
+		err := p.check(c)
+
+		p.mu.Lock()
+		p.health.Checks++
+		p.health.LastCheck = time.Now()
+		if err != nil {
+			p.health.Failures++
+		}
+		p.mu.Unlock()
+
+		p.record(err)
+
+		if err != nil {
+			p.log.Warn("evicting session that failed health check", "upstream", c.RemoteAddr().String(), "err", err)
+			go p.replace(c)
+			continue
+		}
+
+		p.put(c)
+	}
+}
+
+// replace closes a failed session and takes over its slot with a new one,
+// logged in with the same login.
+func (p *Pool) replace(old *epp.Client) {
+	old.Close()
+
+	c, err := p.dialWatched()
+
+	if err == nil {
+		if login := old.LoginFrame(); login != nil {
+			if _, err = c.LoginWithFrame(login); err != nil {
+				c.Close()
+			}
+		}
+	}
+
+	p.record(err)
+
+	if err != nil {
+		p.log.Error("failed to replace session", "err", err)
+		p.release()
+		return
+	}
+
+	p.put(c)
+}
+
+// Stats returns the current number of open, idle and waited for sessions and
+// the pool's health.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.health
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.Waiting = len(p.waiters)
+
+	return s
+}
+
+// Close fails waiting Gets, then logs out and closes the idle sessions,
+// waiting up to LogoutTimeout for each. Borrowed sessions are logged out as
+// they are returned.
+func (p *Pool) Close() {
+	p.mu.Lock()
+
+	if !p.closed {
+		close(p.done)
+	}
+
+	p.closed = true
+
+	idle := p.idle
+
+	p.open -= len(p.idle)
+	p.idle = nil
+
+	for _, w := range p.waiters {
+		w <- handoff{err: ErrClosed}
+	}
+
+	p.waiters = nil
+
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, c := range idle {
+		wg.Add(1)
+		go func(c *epp.Client) {
+			defer wg.Done()
+			p.shutdown(c)
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// shutdown logs a session out and closes it.
+func (p *Pool) shutdown(c *epp.Client) {
+	if err := c.Shutdown(p.logoutTimeout); err != nil {
+		p.log.Warn("failed to log out upstream session", "upstream", c.RemoteAddr().String(), "err", err)
+	}
+}
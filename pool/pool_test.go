@@ -0,0 +1,383 @@
+package pool
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+var xml_greeting = `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting/></epp>`
+
+var xml_response_success = `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response><result code="1000"><msg>Command completed successfully</msg></result></response></epp>`
+
+var xml_command_check = `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check/><clTRID>ABC-1</clTRID></command></epp>`
+
+var xml_command_login = `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><login><clID>client1</clID><pw>secret</pw></login></command></epp>`
+
+// testDialer returns a Dialer for greeted sessions with a registry that
+// answers every command successfully, and a count of sessions dialled.
+func testDialer() (Dialer, *int32) {
+	var dialled int32
+
+	return func() (*epp.Client, error) {
+		atomic.AddInt32(&dialled, 1)
+
+		client, server := net.Pipe()
+
+		go func() {
+			registry := epp.NewConn(server)
+			defer registry.Close()
+
+			registry.WriteFrame(epp.FrameFromString(xml_greeting))
+
+			for {
+				if _, err := registry.ReadFrame(); err != nil {
+					return
+				}
+				registry.WriteFrame(epp.FrameFromString(xml_response_success))
+			}
+		}()
+
+		c := epp.NewClient(client, epp.KeepaliveInterval(0))
+		if _, err := c.Connect(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}, &dialled
+}
+
+func login(t *testing.T, c *epp.Client) {
+	if _, err := c.LoginWithFrame(epp.FrameFromString(xml_command_login)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutKeepsLoggedInSession(t *testing.T) {
+	dial, dialled := testDialer()
+	p, _ := New(dial, MaxOpen(1))
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	login(t, c)
+	p.Put(c)
+
+	again, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != c {
+		t.Error("Expected the returned session to be reused")
+	}
+
+	if !again.LoggedIn() {
+		t.Error("Expected the reused session to still be logged in")
+	}
+
+	if *dialled != 1 {
+		t.Errorf("Expected 1 dial, got %d", *dialled)
+	}
+}
+
+func TestPutKeepsFreshSession(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial)
+	defer p.Close()
+
+	c, _ := p.Get()
+	p.Put(c)
+
+	if s := p.Stats(); s.Idle != 1 {
+		t.Errorf("Expected 1 idle session, got %+v", s)
+	}
+}
+
+func TestPutDiscardsSessionThatIsNotLoggedIn(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial)
+	defer p.Close()
+
+	c, _ := p.Get()
+	c.GetResponse(epp.FrameFromString(xml_command_check))
+	p.Put(c)
+
+	if s := p.Stats(); s.Open != 0 || s.Idle != 0 {
+		t.Errorf("Expected no open sessions, got %+v", s)
+	}
+}
+
+func TestPutDiscardsBrokenSession(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial)
+	defer p.Close()
+
+	c, _ := p.Get()
+	login(t, c)
+	c.Close()
+	c.Hello()
+	p.Put(c)
+
+	if s := p.Stats(); s.Open != 0 {
+		t.Errorf("Expected no open sessions, got %+v", s)
+	}
+}
+
+func TestGetTimesOutAtMaxOpen(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial, MaxOpen(1), WaitTimeout(10*time.Millisecond))
+	defer p.Close()
+
+	p.Get()
+
+	if _, err := p.Get(); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+
+	if s := p.Stats(); s.Waiting != 0 {
+		t.Errorf("Expected no waiters after timeout, got %+v", s)
+	}
+}
+
+func TestWaiterGetsReturnedSession(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial, MaxOpen(1), WaitTimeout(time.Second))
+	defer p.Close()
+
+	c, _ := p.Get()
+	login(t, c)
+
+	got := make(chan *epp.Client)
+	go func() {
+		w, _ := p.Get()
+		got <- w
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.Put(c)
+
+	if w := <-got; w != c {
+		t.Error("Expected the waiter to get the returned session")
+	}
+}
+
+func TestWaiterDialsAfterDiscard(t *testing.T) {
+	dial, dialled := testDialer()
+	p, _ := New(dial, MaxOpen(1), WaitTimeout(time.Second))
+	defer p.Close()
+
+	c, _ := p.Get()
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.Get()
+		errs <- err
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.Discard(c)
+
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if *dialled != 2 {
+		t.Errorf("Expected 2 dials, got %d", *dialled)
+	}
+
+	if s := p.Stats(); s.Open != 1 {
+		t.Errorf("Expected 1 open session, got %+v", s)
+	}
+}
+
+func TestMinIdleIsRefilled(t *testing.T) {
+	dial, _ := testDialer()
+	p, err := New(dial, MinIdle(1), MaxOpen(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if s := p.Stats(); s.Idle != 1 {
+		t.Fatalf("Expected 1 idle session, got %+v", s)
+	}
+
+	c, _ := p.Get()
+	p.Discard(c)
+
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Idle != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s := p.Stats(); s.Idle != 1 || s.Open != 1 {
+		t.Errorf("Expected the idle session to be replaced, got %+v", s)
+	}
+}
+
+func TestCloseLogsOutIdleSessions(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial, MaxOpen(1))
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	login(t, c)
+	p.Put(c)
+
+	p.Close()
+
+	if c.LoggedIn() {
+		t.Error("Expected idle session to be logged out")
+	}
+
+	if _, err := c.Hello(); err == nil {
+		t.Error("Expected idle session to be closed")
+	}
+}
+
+func TestCloseFailsWaiters(t *testing.T) {
+	dial, _ := testDialer()
+	p, _ := New(dial, MaxOpen(1))
+
+	p.Get()
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.Get()
+		errs <- err
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.Close()
+
+	if err := <-errs; err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestHealthCheckReplacesFailedSession(t *testing.T) {
+	dial, dialled := testDialer()
+
+	var checks int32
+	check := func(c *epp.Client) error {
+		if atomic.AddInt32(&checks, 1) == 1 {
+			return errors.New("no answer")
+		}
+		return nil
+	}
+
+	p, _ := New(dial, MaxOpen(1), HealthCheck(5*time.Millisecond, check))
+	defer p.Close()
+
+	c, _ := p.Get()
+	login(t, c)
+	p.Put(c)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&checks) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	replaced, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced == c {
+		t.Error("Expected the failed session to be replaced")
+	}
+
+	if !replaced.LoggedIn() {
+		t.Error("Expected the replacement to be logged in")
+	}
+
+	if *dialled != 2 {
+		t.Errorf("Expected 2 dials, got %d", *dialled)
+	}
+
+	s := p.Stats()
+	if s.Failures != 1 || s.Checks < 2 || s.LastError != "" || s.Open != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func TestIdleSessionThatBreaksIsReplaced(t *testing.T) {
+	var dialled int32
+
+	dial := func() (*epp.Client, error) {
+		n := atomic.AddInt32(&dialled, 1)
+
+		client, server := net.Pipe()
+
+		go func() {
+			registry := epp.NewConn(server)
+			defer registry.Close()
+
+			registry.WriteFrame(epp.FrameFromString(xml_greeting))
+
+			for {
+				f, err := registry.ReadFrame()
+				if err != nil {
+					return
+				}
+
+				// The first registry hangs up on the first keepalive.
+				if n == 1 && !f.IsCommand("login") {
+					return
+				}
+
+				registry.WriteFrame(epp.FrameFromString(xml_response_success))
+			}
+		}()
+
+		c := epp.NewClient(client, epp.KeepaliveInterval(10*time.Millisecond))
+		if _, err := c.Connect(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	p, _ := New(dial, MaxOpen(1))
+	defer p.Close()
+
+	c, _ := p.Get()
+	login(t, c)
+	p.Put(c)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&dialled) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	replaced, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced == c {
+		t.Error("Expected the broken session to be replaced")
+	}
+
+	if !replaced.LoggedIn() {
+		t.Error("Expected the replacement to be logged in")
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/xml"
 	"errors"
-	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/davidrjonas/epplb/audit"
 	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/policy"
+	"github.com/davidrjonas/epplb/xsd"
 )
 
 type UpstreamError error
@@ -19,13 +27,70 @@ type stateFn func() (stateFn, error)
 type Protocol struct {
 	Upstream   *epp.Client
 	Downstream *epp.Conn
+
+	// Proxy names the proxy in metrics.
+	Proxy string
+
+	// Log gets the session's log lines, to which the upstream connection's
+	// addresses are added.
+	Log *slog.Logger
+
+	// Audit, when set, gets a record of every command sent upstream and its
+	// response. Session ties the records to the session's log lines.
+	Audit   *audit.Log
+	Session string
+
+	// Schema, when set, must accept every frame from the client before it
+	// is sent upstream. Those it doesn't get a 2001 from the proxy.
+	Schema *xsd.Schema
+
+	// Policy, when set, must allow every command the logged in client sends
+	// before it goes upstream. Confirm is the command, if any, the client
+	// confirmed it means to send, for rules that ask for that.
+	Policy  *policy.Policy
+	Confirm string
+
+	// Auth, when set, must accept the downstream login's clID and pw before
+	// the upstream session is used.
+	Auth Authenticator
+
+	// Route, when set, picks the upstream session for a downstream login and
+	// the login frame to send on it. A nil client keeps the current Upstream.
+	Route func(login *epp.Frame) (*epp.Client, *epp.Frame, error)
+
+	// upstreamLogin is the login last sent upstream, kept so a resumed
+	// session can log in again on a new upstream.
+	upstreamLogin *epp.Frame
+
+	// clID is the downstream client's, as given in its login.
+	clID string
+
+	// svcs are the services the downstream client logged in with. A shared
+	// upstream session may have been logged in with others, so commands and
+	// responses are held to these.
+	svcs *epp.LoginSvcs
+
+	// ctx bounds waiting on the client for its next frame and on an upstream
+	// for its greeting. Once a command has been read it runs under exchangeCtx
+	// instead, without ctx's cancellation, so a command that may already have
+	// taken effect at the registry gets its response, bounded by the upstream
+	// and downstream timeouts, and the upstream session stays usable.
+	ctx         context.Context
+	exchangeCtx context.Context
 }
 
-func (p *Protocol) Talk() (err error) {
+// Talk runs the session from the greeting until the client logs out or ctx
+// is done.
+func (p *Protocol) Talk(ctx context.Context) (err error) {
+	p.setContext(ctx)
 	return p.run(p.connected)
 }
 
-func (p *Protocol) Resume(f *epp.Frame) error {
+// Resume picks the session up again on a new upstream, starting with f, the
+// frame that failed on the last one.
+func (p *Protocol) Resume(ctx context.Context, f *epp.Frame) error {
+	p.setContext(ctx)
+
 	if f == nil {
 		return p.run(p.connected)
 	}
@@ -38,9 +103,16 @@ func (p *Protocol) Resume(f *epp.Frame) error {
 		}
 		return p.run(stateFn)
 	case "logout":
-		p.Downstream.WriteFrame(f.MakeSuccessResponse())
+		p.respond(f, f.MakeSuccessResponse())
 		return nil
 	default:
+		if err := p.login(); err != nil {
+			return RetryableUpstreamError{
+				UpstreamError: err,
+				failedFrame:   f,
+			}
+		}
+
 		stateFn, err := p.loggedInThenFrame(f)
 		if err != nil {
 			return err
@@ -49,6 +121,11 @@ func (p *Protocol) Resume(f *epp.Frame) error {
 	}
 }
 
+func (p *Protocol) setContext(ctx context.Context) {
+	p.ctx = ctx
+	p.exchangeCtx = context.WithoutCancel(ctx)
+}
+
 func (p *Protocol) run(state stateFn) (err error) {
 	for {
 		if state, err = state(); err != nil {
@@ -64,12 +141,12 @@ func (p *Protocol) run(state stateFn) (err error) {
 }
 
 func (p *Protocol) connected() (stateFn, error) {
-	greeting, err := p.Upstream.Connect()
+	greeting, err := p.Upstream.ConnectContext(p.ctx)
 	if err != nil {
 		return nil, RetryableUpstreamError{UpstreamError: err}
 	}
 
-	if err := p.Downstream.WriteFrame(greeting); err != nil {
+	if err := p.Downstream.WriteFrameContext(p.exchangeCtx, greeting); err != nil {
 		return nil, err
 	}
 
@@ -77,24 +154,87 @@ func (p *Protocol) connected() (stateFn, error) {
 }
 
 func (p *Protocol) greeted() (stateFn, error) {
-	cmd, err := p.Downstream.ReadFrame()
+	cmd, err := p.Downstream.ReadFrameContext(p.ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	commandsTotal.With(p.Proxy, commandLabel(cmd)).Inc()
+
+	if rejected, err := p.rejectInvalid(cmd); rejected {
+		if err != nil {
+			return nil, err
+		}
+		return p.greeted, nil
+	}
+
 	return p.greetedThenFrame(cmd)
 }
 
 func (p *Protocol) greetedThenFrame(cmd *epp.Frame) (stateFn, error) {
 
 	if !cmd.IsCommand("login") {
-		log.Println("expected login command, got", cmd.GetCommand())
-		p.Downstream.WriteFrame(cmd.MakeErrorResponse(errors.New("unauthorized")))
+		p.logger().Warn("expected login command", "cmd", cmd.GetCommand())
+		p.respond(cmd, cmd.MakeErrorResponse(errors.New("unauthorized")))
+		return p.greeted, nil
+	}
+
+	if p.Auth != nil {
+		clID, pw := cmd.GetLoginCredentials()
+
+		if !p.Auth.Authenticate(clID, pw) {
+			p.logger().Warn("downstream authentication failed", "clID", clID)
+			if err := p.respond(cmd, cmd.MakeResultResponse(2200, "Authentication error")); err != nil {
+				return nil, err
+			}
+			return p.greeted, nil
+		}
+	}
+
+	svcs := loginServices(cmd)
+
+	if rejected, err := p.rejectUnsupported(cmd, svcs); rejected {
+		if err != nil {
+			return nil, err
+		}
+		return p.greeted, nil
+	}
+
+	p.clID, _ = cmd.GetLoginCredentials()
+
+	login := cmd
+
+	if p.Route != nil {
+		upstream, routed, err := p.Route(cmd)
+		if err != nil {
+			return nil, RetryableUpstreamError{
+				UpstreamError: err,
+				failedFrame:   cmd,
+			}
+		}
+
+		if upstream != nil {
+			p.Upstream = upstream
+		}
+
+		login = routed
+	}
+
+	p.upstreamLogin = login
+
+	response, err := p.loginResponse()
+	if lErr, ok := err.(*epp.LoginError); ok {
+		// The registry refused the login but the session is fine. Let the
+		// client see why and try again.
+		p.upstreamLogin = nil
+		p.logger().Warn("upstream refused login", "code", lErr.Result.Code)
+		if err := p.respond(cmd, lErr.Response); err != nil {
+			return nil, err
+		}
 		return p.greeted, nil
 	}
 
-	response, err := p.Upstream.LoginWithFrame(cmd)
 	if err != nil {
 		return nil, RetryableUpstreamError{
 			UpstreamError: err,
@@ -102,31 +242,117 @@ func (p *Protocol) greetedThenFrame(cmd *epp.Frame) (stateFn, error) {
 		}
 	}
 
-	if err := p.Downstream.WriteFrame(response); err != nil {
+	p.svcs = svcs
+
+	if err := p.respond(cmd, p.filter(response)); err != nil {
 		return nil, err
 	}
 
 	return p.loggedIn, nil
 }
 
+// loginServices returns the services a login asks for, or nil if it can't be
+// decoded.
+func loginServices(login *epp.Frame) *epp.LoginSvcs {
+	m, err := login.Decode()
+	if err != nil || m.Command == nil || m.Command.Login == nil {
+		return nil
+	}
+
+	return &m.Command.Login.Svcs
+}
+
+// login logs the current Upstream in with the last login sent upstream. It
+// does nothing if there hasn't been one.
+func (p *Protocol) login() error {
+	if p.upstreamLogin == nil {
+		return nil
+	}
+
+	_, err := p.loginResponse()
+
+	return err
+}
+
+func (p *Protocol) loginResponse() (*epp.Frame, error) {
+	// The upstream may be a different session than the one that greeted the
+	// client, so make sure its greeting has been read before logging in.
+	if _, err := p.Upstream.ConnectContext(p.ctx); err != nil {
+		return nil, err
+	}
+
+	// A session from the pool may already be logged in, in which case
+	// nothing goes to the registry and there is nothing to audit.
+	if p.Upstream.LoggedIn() {
+		return p.Upstream.LoginWithFrameContext(p.exchangeCtx, p.upstreamLogin)
+	}
+
+	sent := time.Now()
+	response, err := p.Upstream.LoginWithFrameContext(p.exchangeCtx, p.upstreamLogin)
+
+	if lErr, ok := err.(*epp.LoginError); ok {
+		p.audit(sent, p.upstreamLogin, lErr.Response, nil)
+	} else {
+		p.audit(sent, p.upstreamLogin, response, err)
+	}
+
+	return response, err
+}
+
 func (p *Protocol) loggedIn() (stateFn, error) {
-	cmd, err := p.Downstream.ReadFrame()
+	cmd, err := p.Downstream.ReadFrameContext(p.ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	commandsTotal.With(p.Proxy, commandLabel(cmd)).Inc()
+
+	if rejected, err := p.rejectInvalid(cmd); rejected {
+		if err != nil {
+			return nil, err
+		}
+		return p.loggedIn, nil
+	}
+
 	return p.loggedInThenFrame(cmd)
 }
 
 func (p *Protocol) loggedInThenFrame(cmd *epp.Frame) (stateFn, error) {
 
 	if cmd.IsCommand("logout") {
-		p.Downstream.WriteFrame(cmd.MakeSuccessResponse())
+		p.respond(cmd, cmd.MakeSuccessResponse())
 		return nil, nil
 	}
 
-	response, err := p.Upstream.GetResponse(cmd)
+	// RFC 5730 only allows login on a session that isn't logged in yet.
+	if cmd.IsCommand("login") {
+		p.logger().Warn("login on a logged in session", "clTRID", cmd.GetClTRID())
+		if err := p.respond(cmd, cmd.MakeResultResponse(2002, "Command use error")); err != nil {
+			return nil, err
+		}
+		return p.loggedIn, nil
+	}
+
+	if rejected, err := p.rejectUnnegotiated(cmd); rejected {
+		if err != nil {
+			return nil, err
+		}
+		return p.loggedIn, nil
+	}
+
+	if rejected, err := p.rejectDenied(cmd); rejected {
+		if err != nil {
+			return nil, err
+		}
+		return p.loggedIn, nil
+	}
+
+	start := time.Now()
+	response, err := p.Upstream.GetResponseContext(p.exchangeCtx, cmd)
+	upstreamLatency.With(p.Proxy).Observe(time.Since(start).Seconds())
+
+	p.audit(start, cmd, response, err)
 
 	if err != nil {
 		return nil, RetryableUpstreamError{
@@ -135,9 +361,241 @@ func (p *Protocol) loggedInThenFrame(cmd *epp.Frame) (stateFn, error) {
 		}
 	}
 
-	if err = p.Downstream.WriteFrame(response); err != nil {
+	if err = p.respond(cmd, p.filter(response)); err != nil {
 		return nil, err
 	}
 
 	return p.loggedIn, nil
 }
+
+// rejectInvalid answers cmd with a 2001 if it fails schema validation, quoting
+// the element at fault, and reports whether it did.
+func (p *Protocol) rejectInvalid(cmd *epp.Frame) (bool, error) {
+	if p.Schema == nil {
+		return false, nil
+	}
+
+	err := p.Schema.Validate(cmd.Raw)
+	if err == nil {
+		return false, nil
+	}
+
+	p.logger().Warn("invalid command", "cmd", cmd.GetCommand(), "clTRID", cmd.GetClTRID(), "err", err)
+
+	var options []epp.ResponseOption
+	if vErr, ok := err.(*xsd.ValidationError); ok && vErr.Element != "" {
+		options = append(options, epp.ExtValue(vErr.Element, vErr.Message))
+	}
+
+	return true, p.respond(cmd, cmd.MakeResultResponse(2001, "Command syntax error", options...))
+}
+
+// rejectUnsupported answers a login that asks for an object or extension the
+// registry didn't offer in its greeting, with a 2307 or a 2103 quoting each
+// one, and reports whether it did. Such a login would only be refused
+// upstream.
+func (p *Protocol) rejectUnsupported(login *epp.Frame, svcs *epp.LoginSvcs) (bool, error) {
+	if svcs == nil {
+		return false, nil
+	}
+
+	// The client may be resuming on an upstream that hasn't greeted yet.
+	if _, err := p.Upstream.ConnectContext(p.ctx); err != nil {
+		return false, RetryableUpstreamError{
+			UpstreamError: err,
+			failedFrame:   login,
+		}
+	}
+
+	greeting, err := p.Upstream.Greeting()
+	if err != nil {
+		p.logger().Warn("failed to read upstream greeting", "err", err)
+		return false, nil
+	}
+
+	objURIs, extURIs := greeting.Unsupported(*svcs)
+	if len(objURIs) == 0 && len(extURIs) == 0 {
+		return false, nil
+	}
+
+	clID, _ := login.GetLoginCredentials()
+	p.logger().Warn("login asked for unsupported services", "clID", clID, "objURIs", objURIs, "extURIs", extURIs)
+
+	return true, p.rejectServices(login, objURIs, extURIs, "not offered by the registry")
+}
+
+// rejectUnnegotiated answers a command for an object or with an extension the
+// client didn't ask for at login, as a registry would, and reports whether it
+// did.
+func (p *Protocol) rejectUnnegotiated(cmd *epp.Frame) (bool, error) {
+	if p.svcs == nil {
+		return false, nil
+	}
+
+	objURI, extURIs := cmd.GetServices()
+
+	var objURIs []string
+	if objURI != "" && !contains(p.svcs.ObjURIs, objURI) {
+		objURIs = append(objURIs, objURI)
+	}
+
+	var unnegotiated []string
+	for _, uri := range extURIs {
+		if !contains(p.svcs.ExtURIs, uri) && !contains(unnegotiated, uri) {
+			unnegotiated = append(unnegotiated, uri)
+		}
+	}
+
+	if len(objURIs) == 0 && len(unnegotiated) == 0 {
+		return false, nil
+	}
+
+	p.logger().Warn("command uses services not negotiated at login", "cmd", cmd.GetCommand(), "clTRID", cmd.GetClTRID(), "objURIs", objURIs, "extURIs", unnegotiated)
+
+	return true, p.rejectServices(cmd, objURIs, unnegotiated, "not negotiated at login")
+}
+
+// rejectServices answers cmd with a 2307 naming each of objURIs or, if there
+// are none, a 2103 naming each of extURIs.
+func (p *Protocol) rejectServices(cmd *epp.Frame, objURIs, extURIs []string, reason string) error {
+	code, msg, element, uris := uint16(2307), "Unimplemented object service", "objURI", objURIs
+	if len(objURIs) == 0 {
+		code, msg, element, uris = 2103, "Unimplemented extension", "extURI", extURIs
+	}
+
+	var options []epp.ResponseOption
+	for _, uri := range uris {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(uri))
+		options = append(options, epp.ExtValue("<"+element+">"+b.String()+"</"+element+">", reason))
+	}
+
+	return p.respond(cmd, cmd.MakeResultResponse(code, msg, options...))
+}
+
+// rejectDenied answers a command the policy doesn't allow with the result
+// code and message of the rule that denied it, and reports whether it did.
+// Frames that aren't commands, such as a hello, aren't up to the policy.
+func (p *Protocol) rejectDenied(cmd *epp.Frame) (bool, error) {
+	if p.Policy == nil || cmd.GetCommand() == "" {
+		return false, nil
+	}
+
+	objURI, extURIs := cmd.GetServices()
+
+	d := p.Policy.Decide(policy.Request{
+		ClID:      p.clID,
+		Command:   cmd.GetCommand(),
+		ObjURI:    objURI,
+		Names:     cmd.GetObjectNames(),
+		ExtURIs:   extURIs,
+		Confirmed: p.Confirm != "" && strings.EqualFold(p.Confirm, cmd.GetCommand()),
+	})
+
+	if d.Allowed {
+		return false, nil
+	}
+
+	p.logger().Warn("command denied by policy", "cmd", cmd.GetCommand(), "clTRID", cmd.GetClTRID(), "clID", p.clID, "rule", d.Rule, "code", d.Code)
+
+	return true, p.respond(cmd, cmd.MakeResultResponse(d.Code, d.Message))
+}
+
+// filter drops the extensions of an upstream response that the client didn't
+// ask for at login, which the registry may have added for the services of
+// another client sharing the upstream session.
+func (p *Protocol) filter(response *epp.Frame) *epp.Frame {
+	if p.svcs == nil {
+		return response
+	}
+
+	return response.WithoutExtensions(p.svcs.ExtURIs)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logger returns Log with the addresses of the current upstream connection,
+// which changes when the session is retried or routed to an account.
+func (p *Protocol) logger() *slog.Logger {
+	l := p.Log
+	if l == nil {
+		l = slog.Default()
+	}
+
+	if p.Upstream != nil {
+		l = l.With(
+			"upstream", p.Upstream.RemoteAddr().String(),
+			"upstream_local", p.Upstream.NetConn().LocalAddr().String(),
+		)
+	}
+
+	return l
+}
+
+// audit records cmd, sent upstream at sent, and the response or the error
+// that came back instead. Failing to write the record is logged but doesn't
+// stop the session.
+func (p *Protocol) audit(sent time.Time, cmd, response *epp.Frame, err error) {
+	if p.Audit == nil {
+		return
+	}
+
+	r := audit.Record{
+		Sent:       sent,
+		Received:   time.Now(),
+		Session:    p.Session,
+		Proxy:      p.Proxy,
+		Downstream: p.Downstream.RemoteAddr().String(),
+		ClID:       p.clID,
+		Upstream:   p.Upstream.RemoteAddr().String(),
+		Command:    cmd.GetCommand(),
+		Objects:    cmd.GetObjectNames(),
+		ClTRID:     cmd.GetClTRID(),
+		Request:    string(cmd.Redacted().Raw),
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if response != nil {
+		r.SvTRID = response.GetSvTRID()
+		r.Response = string(response.Redacted().Raw)
+
+		if result, err := response.GetResult(); err == nil {
+			r.Code = int(result.Code)
+		}
+	}
+
+	if err := p.Audit.Write(r); err != nil {
+		p.logger().Error("failed to write audit record", "cmd", r.Command, "err", err)
+	}
+}
+
+// respond sends the response to cmd downstream, logs the exchange and counts
+// its result code.
+func (p *Protocol) respond(cmd, response *epp.Frame) error {
+	code := "unknown"
+	if result, err := response.GetResult(); err == nil {
+		code = strconv.Itoa(int(result.Code))
+	}
+
+	resultsTotal.With(p.Proxy, code).Inc()
+
+	p.logger().Info("command",
+		"cmd", cmd.GetCommand(),
+		"clTRID", cmd.GetClTRID(),
+		"svTRID", response.GetSvTRID(),
+		"code", code,
+	)
+
+	return p.Downstream.WriteFrameContext(p.exchangeCtx, response)
+}
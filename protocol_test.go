@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/policy"
+)
+
+const testGreeting = `<?xml version="1.0" encoding="UTF-8"?><epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><greeting><svID>Test</svID><svDate>2020-01-01T00:00:00Z</svDate><svcMenu><version>1.0</version><lang>en</lang><objURI>urn:ietf:params:xml:ns:domain-1.0</objURI></svcMenu><dcp><access><all/></access><statement><purpose><admin/></purpose><recipient><ours/></recipient><retention><stated/></retention></statement></dcp></greeting></epp>`
+
+const testCheck = `<?xml version="1.0" encoding="UTF-8"?><epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check><domain:check xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name></domain:check></check><clTRID>CL-2</clTRID></command></epp>`
+
+func testLogin() *epp.Frame {
+	return epp.FrameFromString(`<?xml version="1.0" encoding="UTF-8"?><epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><login><clID>client1</clID><pw>secret</pw><options><version>1.0</version><lang>en</lang></options><svcs><objURI>urn:ietf:params:xml:ns:domain-1.0</objURI></svcs></login><clTRID>CL-1</clTRID></command></epp>`)
+}
+
+func registryResponse(clTRID string) *epp.Frame {
+	return epp.FrameFromString(`<?xml version="1.0" encoding="UTF-8"?><epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response><result code="1000"><msg>Command completed successfully</msg></result><trID><clTRID>` + clTRID + `</clTRID><svTRID>REG-` + clTRID + `</svTRID></trID></response></epp>`)
+}
+
+// testSession wires a Protocol to a client and a registry over in-memory
+// pipes. The registry has already sent its greeting.
+func testSession(t *testing.T) (p *Protocol, client, registry *epp.Conn) {
+	t.Helper()
+
+	clientEnd, downstream := net.Pipe()
+	upstream, registryEnd := net.Pipe()
+
+	t.Cleanup(func() {
+		clientEnd.Close()
+		registryEnd.Close()
+	})
+
+	registry = epp.NewConn(registryEnd)
+	go registry.WriteFrame(epp.FrameFromString(testGreeting))
+
+	p = &Protocol{
+		Upstream:   epp.NewClient(upstream, epp.KeepaliveInterval(0)),
+		Downstream: epp.NewConn(downstream),
+		Proxy:      "test",
+		Log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	t.Cleanup(func() { p.Upstream.Close() })
+
+	// A response that never comes fails the test rather than hanging it.
+	return p, epp.NewConn(clientEnd, epp.ReadTimeout(2*time.Second)), registry
+}
+
+// send sends f as the client and returns the response.
+func send(t *testing.T, client *epp.Conn, f *epp.Frame) *epp.Frame {
+	t.Helper()
+
+	if err := client.WriteFrame(f); err != nil {
+		t.Fatalf("failed to write %s; %v", f.GetCommand(), err)
+	}
+
+	response, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("failed to read response to %s; %v", f.GetCommand(), err)
+	}
+
+	return response
+}
+
+// answer reads a command as the registry and responds to it with a 1000.
+func answer(t *testing.T, registry *epp.Conn) *epp.Frame {
+	cmd, err := registry.ReadFrame()
+	if err != nil {
+		t.Errorf("registry failed to read; %v", err)
+		return nil
+	}
+
+	registry.WriteFrame(registryResponse(cmd.GetClTRID()))
+
+	return cmd
+}
+
+func TestCancelledSessionFinishesCommandInFlight(t *testing.T) {
+	p, client, registry := testSession(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	talked := make(chan error, 1)
+	go func() { talked <- p.Talk(ctx) }()
+
+	go func() {
+		answer(t, registry)
+
+		// The proxy is stopped while the check is at the registry.
+		cmd, err := registry.ReadFrame()
+		if err != nil {
+			t.Errorf("registry failed to read; %v", err)
+			return
+		}
+
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		registry.WriteFrame(registryResponse(cmd.GetClTRID()))
+	}()
+
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("failed to read greeting; %v", err)
+	}
+
+	send(t, client, testLogin())
+
+	response := send(t, client, epp.FrameFromString(testCheck))
+	if svTRID := response.GetSvTRID(); svTRID != "REG-CL-2" {
+		t.Errorf("Expected the registry's response to the check, got %s", response.Raw)
+	}
+
+	select {
+	case err := <-talked:
+		if err != context.Canceled {
+			t.Errorf("Expected the session to end cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end once the check was answered")
+	}
+
+	if !p.Upstream.LoggedIn() || p.Upstream.Err() != nil {
+		t.Errorf("Expected the upstream session to stay usable, err=%v", p.Upstream.Err())
+	}
+}
+
+func TestPolicyLeavesHelloAlone(t *testing.T) {
+	p, client, registry := testSession(t)
+
+	pol, err := policy.New(nil, policy.Deny)
+	if err != nil {
+		t.Fatalf("policy.New failed with %v", err)
+	}
+	p.Policy = pol
+
+	go p.Talk(context.Background())
+
+	go func() {
+		answer(t, registry)
+
+		// Only the hello gets here; the check is denied by the proxy.
+		if _, err := registry.ReadFrame(); err != nil {
+			t.Errorf("registry failed to read; %v", err)
+			return
+		}
+
+		registry.WriteFrame(epp.FrameFromString(testGreeting))
+	}()
+
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("failed to read greeting; %v", err)
+	}
+
+	send(t, client, testLogin())
+
+	response := send(t, client, epp.FrameFromString(testCheck))
+	if result, err := response.GetResult(); err != nil || result.Code != 2201 {
+		t.Errorf("Expected the check to be denied with 2201, got %s", response.Raw)
+	}
+
+	response = send(t, client, epp.MakeHelloFrame())
+	if _, err := response.DecodeGreeting(); err != nil {
+		t.Errorf("Expected the registry's greeting in answer to a hello, got %s", response.Raw)
+	}
+}
+
+func TestSecondLoginIsCommandUseError(t *testing.T) {
+	p, client, registry := testSession(t)
+
+	go p.Talk(context.Background())
+
+	next := make(chan string, 1)
+	go func() {
+		answer(t, registry)
+
+		// The second login is answered by the proxy, so the check comes next.
+		if cmd := answer(t, registry); cmd != nil {
+			next <- cmd.GetCommand()
+		}
+	}()
+
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("failed to read greeting; %v", err)
+	}
+
+	send(t, client, testLogin())
+
+	response := send(t, client, testLogin())
+	if result, err := response.GetResult(); err != nil || result.Code != 2002 {
+		t.Errorf("Expected a second login to get 2002, got %s", response.Raw)
+	}
+
+	send(t, client, epp.FrameFromString(testCheck))
+
+	if cmd := <-next; cmd != "check" {
+		t.Errorf("Expected only the check to follow the login upstream, got %s", cmd)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidrjonas/epplb/audit"
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/policy"
+	"github.com/davidrjonas/epplb/rfc5734"
+	"github.com/davidrjonas/epplb/xsd"
+)
+
+// Proxy is one named listener wired to one upstream registry with its own
+// pool. Proxies are started and stopped independently of each other.
+type Proxy struct {
+	Name    string
+	config  ProxyConfig
+	server  *rfc5734.Server
+	gateway *Gateway
+
+	// Audit, when set, records the commands the proxy's clients send to the
+	// registry.
+	Audit *audit.Log
+
+	// policy decides which commands clients may send. It is replaced in
+	// place by ReloadPolicy.
+	policy *policy.Policy
+
+	// mu guards the pools, which the admin server reads for health.
+	mu        sync.Mutex
+	balancer  *balancer
+	upstreams upstreamSource
+	accounts  map[string]*Account
+}
+
+func NewProxy(config ProxyConfig) *Proxy {
+	return &Proxy{Name: config.Name, config: config}
+}
+
+func connOptions(t TimeoutsConfig, maxFrameSize uint32) []epp.ConnOption {
+	return []epp.ConnOption{
+		epp.MaxFrameSize(maxFrameSize),
+		epp.ReadTimeout(time.Duration(t.Read)),
+		epp.WriteTimeout(time.Duration(t.Write)),
+		epp.IdleTimeout(time.Duration(t.Idle)),
+	}
+}
+
+func (p *Proxy) Start() error {
+	if p.server != nil {
+		return errors.New("proxy already started")
+	}
+
+	upstream := p.config.Upstream
+
+	var auth Authenticator
+	if len(p.config.Clients) > 0 {
+		store, err := NewCredentialStore(p.config.Clients)
+		if err != nil {
+			return err
+		}
+		auth = store
+	}
+
+	var schema *xsd.Schema
+	if validation := p.config.Downstream.Validation; validation != nil {
+		s, err := xsd.Load(validation.ExtensionSchemas)
+		if err != nil {
+			return err
+		}
+		schema = s
+	}
+
+	rules, defaultAction := p.config.Policy.PolicyRules()
+
+	pol, err := policy.New(rules, defaultAction)
+	if err != nil {
+		return fmt.Errorf("invalid policy; %v", err)
+	}
+
+	p.warnConfirmRules(rules)
+
+	p.policy = pol
+
+	b, err := newBalancer(p.Name, &upstream)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.balancer = b
+	p.mu.Unlock()
+
+	factory := countingFactory(p.Name, b.Dial)
+	logger := slog.With("proxy", p.Name)
+
+	clientOptions := []epp.ClientOption{
+		epp.KeepaliveInterval(time.Duration(upstream.KeepaliveInterval)),
+		epp.KeepaliveHook(keepaliveCounter(p.Name)),
+		epp.ConnOptions(connOptions(upstream.Timeouts, p.config.MaxFrameSize)...),
+		epp.Logger(logger),
+	}
+
+	upstreams, err := newUpstreamSource(upstream.Pool, &upstream, factory, clientOptions, logger)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.upstreams = upstreams
+	p.mu.Unlock()
+
+	accounts, err := p.createAccounts(factory, clientOptions)
+	if err != nil {
+		p.closePools()
+		return err
+	}
+
+	serverOptions := []rfc5734.ServerOption{rfc5734.Logger(logger)}
+	var identities map[string]string
+
+	if downstreamTLS := p.config.Downstream.TLS; downstreamTLS != nil {
+		tlsConfig, err := loadServerTlsConfig(downstreamTLS)
+		if err != nil {
+			p.closePools()
+			return err
+		}
+
+		serverOptions = append(serverOptions, rfc5734.TLS(tlsConfig))
+		identities = downstreamTLS.Identities
+	}
+
+	listener, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		p.closePools()
+		return fmt.Errorf("failed to listen; address=%s, err=%v", p.config.Listen, err)
+	}
+
+	h := ProxyHandler{
+		Name:              p.Name,
+		upstreams:         upstreams,
+		MaxRetries:        p.config.MaxRetries,
+		Auth:              auth,
+		Accounts:          accounts,
+		Identities:        identities,
+		DownstreamOptions: connOptions(p.config.Downstream.Timeouts, p.config.MaxFrameSize),
+		Audit:             p.Audit,
+		Schema:            schema,
+		Policy:            pol,
+	}
+
+	if httpConfig := p.config.HTTP; httpConfig != nil {
+		if err := p.startGateway(httpConfig, h); err != nil {
+			listener.Close()
+			p.closePools()
+			return err
+		}
+	}
+
+	p.server = rfc5734.NewServer(listener, serverOptions...)
+
+	go p.server.Serve(h.Handle)
+
+	var addresses []string
+	for _, e := range upstream.EndpointConfigs() {
+		addresses = append(addresses, e.Address)
+	}
+
+	slog.Info("proxy started", "proxy", p.Name, "listen", p.config.Listen, "upstream", strings.Join(addresses, ","), "balance", upstream.Balance)
+
+	return nil
+}
+
+// ReloadPolicy replaces the rules of a started proxy's policy. Sessions
+// already logged in use the new rules from their next command.
+func (p *Proxy) ReloadPolicy(c *PolicyConfig) error {
+	if p.policy == nil {
+		return errors.New("proxy not started")
+	}
+
+	rules, defaultAction := c.PolicyRules()
+
+	if err := p.policy.Update(rules, defaultAction); err != nil {
+		return err
+	}
+
+	p.warnConfirmRules(rules)
+
+	return nil
+}
+
+// warnConfirmRules warns of confirm rules, which always deny commands from
+// the TCP listener since only the HTTP gateway can confirm them.
+func (p *Proxy) warnConfirmRules(rules []policy.Rule) {
+	for i, r := range rules {
+		if r.Action == policy.Confirm {
+			slog.Warn("confirm rule always denies commands from TCP clients", "proxy", p.Name, "rule", i)
+		}
+	}
+}
+
+// Stop closes the listener, waits for the proxy's clients to finish and then
+// logs out and closes its upstream sessions.
+func (p *Proxy) Stop() {
+	if p.server == nil {
+		return
+	}
+
+	slog.Info("closing listener and waiting for clients to finish", "proxy", p.Name)
+
+	if p.gateway != nil {
+		p.gateway.Stop()
+		p.gateway = nil
+	}
+
+	p.server.Stop()
+	p.closePools()
+
+	p.server = nil
+}
+
+// startGateway serves h over HTTP. Identities are per listener, so gateway
+// sessions are mapped by http.tls rather than downstream.tls.
+func (p *Proxy) startGateway(config *HTTPConfig, h ProxyHandler) error {
+	var tlsConfig *tls.Config
+
+	h.Identities = nil
+
+	if config.TLS != nil {
+		var err error
+		if tlsConfig, err = loadServerTlsConfig(config.TLS); err != nil {
+			return err
+		}
+
+		h.Identities = config.TLS.Identities
+	}
+
+	gateway := NewGateway(p.Name, config.Listen, h.Handle, time.Duration(config.Timeout), p.config.MaxFrameSize)
+
+	if err := gateway.Start(tlsConfig); err != nil {
+		return err
+	}
+
+	slog.Info("http gateway started", "proxy", p.Name, "listen", config.Listen)
+
+	p.gateway = gateway
+
+	return nil
+}
+
+// createAccounts makes a pool for each configured client, keyed by its
+// downstream clID, so no session logged in for one client is handed to
+// another. Clients with their own registry account log in with it; the
+// others log in with their own credentials.
+func (p *Proxy) createAccounts(factory connFactory, options []epp.ClientOption) (map[string]*Account, error) {
+	p.mu.Lock()
+	p.accounts = make(map[string]*Account)
+	p.mu.Unlock()
+
+	for _, client := range p.config.Clients {
+		account := &Account{}
+		poolConfig := p.config.Upstream.Pool
+		poolConfig.MinIdle = 0
+
+		if client.Registry != nil {
+			account.ClID = client.Registry.ClID
+			account.Password = client.Registry.Password
+			poolConfig = client.Registry.Pool
+		}
+
+		upstreams, err := newUpstreamSource(poolConfig, &p.config.Upstream, factory, options, slog.With("proxy", p.Name, "clid", client.ClID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create account pool; clid=%s, err=%v", client.ClID, err)
+		}
+
+		account.upstreams = upstreams
+
+		p.mu.Lock()
+		p.accounts[client.ClID] = account
+		p.mu.Unlock()
+	}
+
+	return p.accounts, nil
+}
+
+// closePools logs out of every pool at once, so that each waits at most one
+// logout timeout.
+func (p *Proxy) closePools() {
+	p.mu.Lock()
+
+	var sources []upstreamSource
+
+	if p.upstreams != nil {
+		sources = append(sources, p.upstreams)
+		p.upstreams = nil
+	}
+
+	for _, account := range p.accounts {
+		sources = append(sources, account.upstreams)
+	}
+
+	p.accounts = nil
+
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source upstreamSource) {
+			defer wg.Done()
+			source.Close()
+		}(source)
+	}
+
+	wg.Wait()
+}
+
+// Health reports the state of the proxy's pools and endpoints. A proxy is
+// healthy when it is running, none of its pools has a failing health check
+// or dial and at least one endpoint is not ejected.
+func (p *Proxy) Health() ProxyHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var h ProxyHealth
+
+	if p.upstreams == nil {
+		return h
+	}
+
+	upstream := upstreamHealth(p.upstreams.Stats())
+	h.Upstream = &upstream
+	h.Healthy = upstream.Healthy
+
+	h.Endpoints = p.balancer.Health()
+
+	up := false
+	for _, e := range h.Endpoints {
+		up = up || !e.Ejected
+	}
+	h.Healthy = h.Healthy && up
+
+	if len(p.accounts) > 0 {
+		h.Accounts = make(map[string]UpstreamHealth, len(p.accounts))
+	}
+
+	for clID, account := range p.accounts {
+		a := upstreamHealth(account.upstreams.Stats())
+		h.Accounts[clID] = a
+		h.Healthy = h.Healthy && a.Healthy
+	}
+
+	return h
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProxyRestart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := listener.Addr().String()
+	listener.Close()
+
+	config := validConfig(t).Proxies[0]
+	config.Listen = listen
+	// Only the client below dials the registry, and it is refused.
+	config.Upstream.Address = "127.0.0.1:1"
+	config.Upstream.Pool.MinIdle = 0
+
+	p := NewProxy(config)
+
+	for i := 0; i < 2; i++ {
+		if err := p.Start(); err != nil {
+			t.Fatalf("Start %d failed with %v", i+1, err)
+		}
+
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatalf("Expected the proxy to accept connections after Start %d, got %v", i+1, err)
+		}
+		conn.Close()
+
+		p.Stop()
+	}
+
+	if _, err := net.Dial("tcp", listen); err == nil {
+		t.Error("Expected a stopped proxy to refuse connections")
+	}
+}
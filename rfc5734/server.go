@@ -1,32 +1,81 @@
 package rfc5734
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 )
 
-type Handler func(net.Conn) error
+// Handler serves one connection. ctx is cancelled when the server starts to
+// stop, so handlers waiting on the client can give up.
+type Handler func(ctx context.Context, conn net.Conn) error
 
 type Server struct {
-	listener      *net.TCPListener
-	acceptTimeout time.Duration
-	stop          chan bool
-	done          chan bool
+	listener         *net.TCPListener
+	acceptTimeout    time.Duration
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration
+	log              *slog.Logger
+	ctx              context.Context
+	cancel           context.CancelFunc
+	stop             chan bool
+	done             chan bool
 }
 
-func NewServer(listener net.Listener) *Server {
-	return &Server{
-		listener:      listener.(*net.TCPListener),
-		acceptTimeout: 10 * time.Millisecond,
-		stop:          make(chan bool),
-		done:          make(chan bool, 1),
+type ServerOption func(*Server)
+
+// TLS makes the server speak TLS, as RFC 5734 requires, on every accepted
+// connection. Handlers receive a *tls.Conn whose handshake is complete.
+func TLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// HandshakeTimeout limits how long a client may take to complete the TLS
+// handshake.
+func HandshakeTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.handshakeTimeout = d
+	}
+}
+
+// Logger is where the server logs connections that fail. It defaults to
+// slog's default logger.
+func Logger(l *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+func NewServer(listener net.Listener, options ...ServerOption) *Server {
+	s := Server{
+		listener:         listener.(*net.TCPListener),
+		acceptTimeout:    10 * time.Millisecond,
+		handshakeTimeout: 10 * time.Second,
+		log:              slog.Default(),
+		stop:             make(chan bool),
+		done:             make(chan bool, 1),
+	}
+
+	for _, opt := range options {
+		opt(&s)
 	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	return &s
 }
 
+// Stop closes the listener, cancels the context of every connection and
+// waits for their handlers to return.
 func (s *Server) Stop() {
+	s.cancel()
 	close(s.stop)
+	s.listener.Close()
 	<-s.done
 }
 
@@ -40,31 +89,60 @@ OUTER:
 		conn, err := s.listener.Accept()
 
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
-				log.Printf("error accepting connection: %v", err)
-			}
-
 			select {
 			case <-s.stop:
 				break OUTER
 			default:
-				continue OUTER
 			}
+
+			if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+				s.log.Error("error accepting connection", "err", err)
+			}
+
+			continue OUTER
 		}
 
 		wg.Add(1)
 
 		go func(handle Handler, conn net.Conn, done func()) {
-			if err := handle(conn); err != nil {
-				log.Printf("connection error: %v", err)
+			defer done()
+			defer func() { conn.Close() }()
+
+			if s.tlsConfig != nil {
+				tlsConn, err := s.handshake(conn)
+				if err != nil {
+					s.log.Warn("tls handshake failed", "downstream", conn.RemoteAddr().String(), "err", err)
+					return
+				}
+				conn = tlsConn
+			}
+
+			ctx, cancel := context.WithCancel(s.ctx)
+			defer cancel()
+
+			if err := handle(ctx, conn); err != nil {
+				s.log.Warn("connection error", "downstream", conn.RemoteAddr().String(), "err", err)
 			}
-			conn.Close()
-			done()
 		}(handle, conn, wg.Done)
 	}
 
-	log.Println("waiting for clients to finish")
+	s.log.Info("waiting for clients to finish")
 
 	wg.Wait()
 	s.done <- true
 }
+
+func (s *Server) handshake(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, s.tlsConfig)
+
+	if s.handshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,92 @@
+package rfc5734
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStopClosesListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+
+	s := NewServer(listener)
+	go s.Serve(func(ctx context.Context, conn net.Conn) error { return nil })
+	s.Stop()
+
+	// A stopped server's address is free for the next one.
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected to listen on %s again after Stop, got %v", addr, err)
+	}
+
+	s = NewServer(listener)
+	go s.Serve(func(ctx context.Context, conn net.Conn) error { return nil })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Expected the restarted server to accept connections, got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	s.Stop()
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from the server's goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestServerLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out syncBuffer
+
+	s := NewServer(listener, Logger(slog.New(slog.NewTextHandler(&out, nil)).With("proxy", "test")))
+
+	handled := make(chan struct{})
+	go s.Serve(func(ctx context.Context, conn net.Conn) error {
+		defer close(handled)
+		return errors.New("broken")
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	<-handled
+	s.Stop()
+
+	logged := out.String()
+	if !strings.Contains(logged, `msg="connection error" proxy=test downstream=`+conn.LocalAddr().String()+" err=broken") {
+		t.Errorf("Expected the connection error to go to the server's logger, got %s", logged)
+	}
+}
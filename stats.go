@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/metrics"
+)
+
+var (
+	downstreamConnections = metrics.NewCounterVec("epplb_downstream_connections_total", "Downstream connections accepted.", "proxy")
+	upstreamCreated       = metrics.NewCounterVec("epplb_upstream_connections_created_total", "Upstream connections opened.", "proxy")
+	upstreamUnusable      = metrics.NewCounterVec("epplb_upstream_connections_unusable_total", "Upstream connections marked unusable.", "proxy")
+	keepalivesTotal       = metrics.NewCounterVec("epplb_keepalive_hellos_total", "Keepalive hellos sent upstream.", "proxy", "status")
+	retriesTotal          = metrics.NewCounterVec("epplb_retries_total", "Frames retried on a new upstream connection.", "proxy")
+	commandsTotal         = metrics.NewCounterVec("epplb_commands_total", "Downstream commands by type.", "proxy", "command")
+	resultsTotal          = metrics.NewCounterVec("epplb_results_total", "Responses sent downstream by result code.", "proxy", "code")
+	upstreamLatency       = metrics.NewHistogramVec("epplb_upstream_latency_seconds", "Upstream command round trip time.", metrics.DefaultBuckets, "proxy")
+)
+
+// commands are the RFC 5730 commands, the only values the command label takes
+// besides hello and other, so that clients can't add labels of their own.
+var commands = []string{"login", "logout", "poll", "check", "info", "create", "update", "delete", "renew", "transfer"}
+
+// commandLabel is the command label for a frame from a client.
+func commandLabel(f *epp.Frame) string {
+	if cmd := f.GetCommand(); contains(commands, cmd) {
+		return cmd
+	}
+
+	if f.IsHello() {
+		return "hello"
+	}
+
+	return "other"
+}
+
+// countingFactory counts the upstream connections a pool opens.
+func countingFactory(proxy string, factory func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := factory()
+		if err == nil {
+			upstreamCreated.With(proxy).Inc()
+		}
+		return conn, err
+	}
+}
+
+// keepaliveCounter counts the outcome of keepalive hellos.
+func keepaliveCounter(proxy string) func(error) {
+	return func(err error) {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		keepalivesTotal.With(proxy, status).Inc()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+func TestCommandLabel(t *testing.T) {
+	for _, tc := range []struct {
+		frame string
+		label string
+	}{
+		{testCheck, "check"},
+		{string(testLogin().Raw), "login"},
+		{string(epp.MakeHelloFrame().Raw), "hello"},
+		{`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><frobnicate/></command></epp>`, "other"},
+		{`<epp xmlns="urn:example"><command><check/></command></epp>`, "other"},
+		{`not xml`, "other"},
+	} {
+		if label := commandLabel(epp.FrameFromString(tc.frame)); label != tc.label {
+			t.Errorf("Expected %s for %s, got %s", tc.label, tc.frame, label)
+		}
+	}
+}
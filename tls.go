@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// loadServerTlsConfig builds the downstream listener's TLS config. With a
+// client CA, clients must present a certificate signed by it.
+func loadServerTlsConfig(c *ServerTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cert and key; certFile=%s, keyFile=%s, err=%v", c.Cert, c.Key, err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version; min_version=%s", c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite; name=%s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	if c.ClientCA != "" {
+		caCert, err := ioutil.ReadFile(c.ClientCA)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client ca file; caFile=%s, err=%v", c.ClientCA, err)
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in client ca file; caFile=%s", c.ClientCA)
+		}
+
+		tlsConfig.ClientCAs = caCertPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// peerSubject returns the subject of the client certificate on a TLS
+// connection, or "" if there is none.
+func peerSubject(c net.Conn) string {
+	if s, ok := c.(interface{ PeerSubject() string }); ok {
+		return s.PeerSubject()
+	}
+
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	return certs[0].Subject.String()
+}
+
+// identityAuthenticator only accepts logins for the registrar identity the
+// client certificate is mapped to, then defers to the next Authenticator.
+type identityAuthenticator struct {
+	next Authenticator
+	clID string
+}
+
+func (a *identityAuthenticator) Authenticate(clID, pw string) bool {
+	if a.clID == "" || clID != a.clID {
+		return false
+	}
+
+	if a.next == nil {
+		return true
+	}
+
+	return a.next.Authenticate(clID, pw)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+)
+
+// clientTLSConfig trusts the test CA and, with withCert, presents the client
+// certificate.
+func clientTLSConfig(t *testing.T, pki *testPKI, withCert bool) *tls.Config {
+	ca, err := os.ReadFile(pki.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(pki.ClientCert, pki.ClientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config
+}
+
+// handshake runs a TLS handshake over loopback TCP, whose buffering lets
+// the server's alert for a refused client go out without the client reading
+// it, and returns both ends and the server's handshake error.
+func handshake(t *testing.T, server, client *tls.Config) (*tls.Conn, *tls.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := net.Dial("tcp", listener.Addr().String())
+		dialed <- conn
+	}()
+
+	a, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := <-dialed
+	if b == nil {
+		t.Fatal("failed to dial the listener")
+	}
+
+	s, c := tls.Server(a, server), tls.Client(b, client)
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+
+	go c.Handshake()
+
+	return s, c, s.Handshake()
+}
+
+func TestLoadServerTlsConfig(t *testing.T) {
+	pki := newTestPKI(t)
+
+	config, err := loadServerTlsConfig(&ServerTLSConfig{Cert: pki.Cert, Key: pki.Key})
+	if err != nil {
+		t.Fatalf("loadServerTlsConfig failed with %v", err)
+	}
+
+	if config.MinVersion != tls.VersionTLS12 || config.ClientAuth != tls.NoClientCert || config.CipherSuites != nil {
+		t.Errorf("Expected TLS 1.2, no client certs and Go's cipher suites by default, got %+v", config)
+	}
+
+	config, err = loadServerTlsConfig(&ServerTLSConfig{
+		Cert:         pki.Cert,
+		Key:          pki.Key,
+		ClientCA:     pki.CA,
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+	})
+	if err != nil {
+		t.Fatalf("loadServerTlsConfig failed with %v", err)
+	}
+
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x", config.MinVersion)
+	}
+
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Error("Expected a client CA to require client certificates")
+	}
+
+	expected := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if len(config.CipherSuites) != 2 || config.CipherSuites[0] != expected[0] || config.CipherSuites[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, config.CipherSuites)
+	}
+}
+
+func TestLoadServerTlsConfigErrors(t *testing.T) {
+	pki := newTestPKI(t)
+
+	for _, tc := range []struct {
+		config ServerTLSConfig
+		err    string
+	}{
+		{ServerTLSConfig{Cert: "missing.pem", Key: pki.Key}, "failed to load cert and key"},
+		{ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, MinVersion: "1.4"}, "unknown tls version"},
+		{ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, "unknown or insecure cipher suite"},
+		{ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, ClientCA: "missing.pem"}, "failed to load client ca file"},
+		{ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, ClientCA: pki.Key}, "no certificates found"},
+	} {
+		_, err := loadServerTlsConfig(&tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected an error containing '%s', got %v", tc.err, err)
+		}
+	}
+}
+
+func TestServerTLSHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+
+	server, err := loadServerTlsConfig(&ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, ClientCA: pki.CA})
+	if err != nil {
+		t.Fatalf("loadServerTlsConfig failed with %v", err)
+	}
+
+	s, _, err := handshake(t, server, clientTLSConfig(t, pki, true))
+	if err != nil {
+		t.Fatalf("Expected the handshake to succeed, got %v", err)
+	}
+
+	if subject := peerSubject(s); subject != "CN=client1,O=Example" {
+		t.Errorf("Expected the client certificate's subject, got '%s'", subject)
+	}
+
+	if _, _, err := handshake(t, server, clientTLSConfig(t, pki, false)); err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+}
+
+func TestServerTLSMinVersion(t *testing.T) {
+	pki := newTestPKI(t)
+
+	server, err := loadServerTlsConfig(&ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("loadServerTlsConfig failed with %v", err)
+	}
+
+	client := clientTLSConfig(t, pki, false)
+	client.MaxVersion = tls.VersionTLS12
+
+	if _, _, err := handshake(t, server, client); err == nil {
+		t.Error("Expected a TLS 1.2 client to be refused")
+	}
+}
+
+// identitySession runs a login over TLS through a ProxyHandler that maps
+// subject to client1, and returns the response and whether the registry got
+// the login.
+func identitySession(t *testing.T, subject string) (*epp.Frame, bool) {
+	pki := newTestPKI(t)
+
+	server, err := loadServerTlsConfig(&ServerTLSConfig{Cert: pki.Cert, Key: pki.Key, ClientCA: pki.CA})
+	if err != nil {
+		t.Fatalf("loadServerTlsConfig failed with %v", err)
+	}
+
+	s, c, err := handshake(t, server, clientTLSConfig(t, pki, true))
+	if err != nil {
+		t.Fatalf("handshake failed with %v", err)
+	}
+
+	upstreams, commands := registrySource(t)
+
+	h := &ProxyHandler{
+		Name:       "test",
+		upstreams:  upstreams,
+		Identities: map[string]string{subject: "client1"},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.Handle(context.Background(), s) }()
+
+	client := epp.NewConn(c, epp.ReadTimeout(2*time.Second))
+
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("failed to read greeting; %v", err)
+	}
+
+	response := send(t, client, testLogin())
+
+	c.Close()
+	<-done
+
+	select {
+	case cmd := <-commands:
+		return response, cmd == "login"
+	default:
+		return response, false
+	}
+}
+
+func TestIdentityMapped(t *testing.T) {
+	response, sent := identitySession(t, "CN=client1,O=Example")
+
+	if !response.IsSuccess() || !sent {
+		t.Errorf("Expected a mapped certificate to log in, got %s", response.Raw)
+	}
+}
+
+func TestIdentityUnmapped(t *testing.T) {
+	response, sent := identitySession(t, "CN=someone-else,O=Example")
+
+	if result, err := response.GetResult(); err != nil || result.Code != 2200 {
+		t.Errorf("Expected an unmapped certificate to get 2200, got %s", response.Raw)
+	}
+
+	if sent {
+		t.Error("Expected the login not to reach the registry")
+	}
+}
+
+func TestIdentityAuthenticator(t *testing.T) {
+	store := authFunc(func(clID, pw string) bool { return pw == "secret" })
+
+	for _, tc := range []struct {
+		a        *identityAuthenticator
+		clID, pw string
+		ok       bool
+	}{
+		{&identityAuthenticator{clID: "client1"}, "client1", "anything", true},
+		{&identityAuthenticator{clID: "client1"}, "client2", "anything", false},
+		{&identityAuthenticator{}, "", "", false},
+		{&identityAuthenticator{next: store, clID: "client1"}, "client1", "secret", true},
+		{&identityAuthenticator{next: store, clID: "client1"}, "client1", "wrong", false},
+	} {
+		if ok := tc.a.Authenticate(tc.clID, tc.pw); ok != tc.ok {
+			t.Errorf("Expected %v for %s mapped to '%s', got %v", tc.ok, tc.clID, tc.a.clID, ok)
+		}
+	}
+}
+
+type authFunc func(clID, pw string) bool
+
+func (f authFunc) Authenticate(clID, pw string) bool { return f(clID, pw) }
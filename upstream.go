@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidrjonas/epplb/epp"
+	"github.com/davidrjonas/epplb/pool"
+)
+
+// connFactory opens a connection to the upstream registry.
+type connFactory func() (net.Conn, error)
+
+// upstreamSource hands out upstream sessions to downstream connections.
+type upstreamSource interface {
+	Get() (*epp.Client, error)
+
+	// Release gives back a session. Unhealthy sessions are closed.
+	Release(c *epp.Client, healthy bool)
+
+	// Stats reports the sessions and health of the source.
+	Stats() pool.Stats
+
+	// Close logs out and closes the source's sessions.
+	Close()
+}
+
+// newUpstreamSource makes a source for one pool of upstream sessions, shared
+// between downstream clients when multiplex is set and dedicated otherwise.
+// The source logs the sessions it evicts and fails to replace to logger.
+func newUpstreamSource(config PoolConfig, upstream *UpstreamConfig, factory connFactory, options []epp.ClientOption, logger *slog.Logger) (upstreamSource, error) {
+	if upstream.Multiplex != nil {
+		return newSharedSource(config, upstream.Multiplex.Pipeline, upstream.HealthCheck, time.Duration(upstream.Timeouts.Logout), factory, options, logger)
+	}
+
+	return newDedicatedSource(config, upstream.HealthCheck, time.Duration(upstream.Timeouts.Logout), factory, options, logger)
+}
+
+// healthChecker sends command on logged in sessions and a hello otherwise.
+// A command fails the check if the registry refuses it.
+func healthChecker(command string) pool.Checker {
+	return func(c *epp.Client) error {
+		if command == "" || !c.LoggedIn() {
+			_, err := c.Hello()
+			return err
+		}
+
+		response, err := c.GetResponse(epp.FrameFromString(command))
+		if err != nil {
+			return err
+		}
+
+		if response.IsFailure() {
+			result, _ := response.GetResult()
+			return fmt.Errorf("health check command failed; code=%d, msg=%s", result.Code, result.Msg)
+		}
+
+		return nil
+	}
+}
+
+// ejectUnready blames a session's endpoint when the session failed before it
+// could log in.
+func ejectUnready(c *epp.Client) {
+	if !c.LoggedIn() {
+		ejectEndpoint(c.NetConn(), errors.New("session failed before logging in"))
+	}
+}
+
+// dedicatedSource lends each downstream connection an upstream session of
+// its own for as long as it is connected, then takes it back for the next.
+type dedicatedSource struct {
+	pool *pool.Pool
+}
+
+func newDedicatedSource(config PoolConfig, health *HealthCheckConfig, logoutTimeout time.Duration, factory connFactory, options []epp.ClientOption, logger *slog.Logger) (*dedicatedSource, error) {
+	dial := func() (*epp.Client, error) {
+		conn, err := factory()
+		if err != nil {
+			return nil, err
+		}
+
+		c := epp.NewClient(conn, options...)
+		trackSession(conn, c)
+
+		if _, err := c.Connect(); err != nil {
+			ejectEndpoint(conn, err)
+			c.Close()
+			return nil, fmt.Errorf("failed to read greeting; %v", err)
+		}
+
+		return c, nil
+	}
+
+	poolOptions := []pool.Option{
+		pool.MinIdle(config.MinIdle),
+		pool.MaxOpen(config.MaxOpen),
+		pool.WaitTimeout(time.Duration(config.WaitTimeout)),
+		pool.LogoutTimeout(logoutTimeout),
+		pool.Logger(logger),
+	}
+
+	if health != nil {
+		poolOptions = append(poolOptions, pool.HealthCheck(time.Duration(health.Interval), healthChecker(health.Command)))
+	}
+
+	p, err := pool.New(dial, poolOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pool; %v", err)
+	}
+
+	return &dedicatedSource{pool: p}, nil
+}
+
+func (s *dedicatedSource) Get() (*epp.Client, error) {
+	return s.pool.Get()
+}
+
+func (s *dedicatedSource) Release(c *epp.Client, healthy bool) {
+	if healthy {
+		s.pool.Put(c)
+		return
+	}
+
+	ejectUnready(c)
+	s.pool.Discard(c)
+}
+
+func (s *dedicatedSource) Stats() pool.Stats {
+	return s.pool.Stats()
+}
+
+func (s *dedicatedSource) Close() {
+	s.pool.Close()
+}
+
+// sharedSource multiplexes downstream connections over up to max pipelined
+// upstream sessions, handing out the one with the fewest commands in flight.
+// Sessions are dialled when all of the others are busy and are greeted and
+// logged in once, by the first downstream connection to use them.
+type sharedSource struct {
+	factory connFactory
+	max     int
+	options []epp.ClientOption
+	logout  time.Duration
+	log     *slog.Logger
+	mu      sync.Mutex
+	clients []*epp.Client
+	health  pool.Stats
+	done    chan struct{}
+}
+
+func newSharedSource(config PoolConfig, pipeline int, health *HealthCheckConfig, logoutTimeout time.Duration, factory connFactory, options []epp.ClientOption, logger *slog.Logger) (*sharedSource, error) {
+	s := &sharedSource{
+		factory: factory,
+		max:     config.MaxOpen,
+		options: append(append([]epp.ClientOption(nil), options...), epp.Pipeline(pipeline)),
+		logout:  logoutTimeout,
+		log:     logger,
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < config.MinIdle; i++ {
+		if err := s.dial(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to create pool; %v", err)
+		}
+	}
+
+	if health != nil {
+		go s.checkLoop(time.Duration(health.Interval), healthChecker(health.Command))
+	}
+
+	return s, nil
+}
+
+// dial adds a session. The caller holds mu unless the source is still being
+// built.
+func (s *sharedSource) dial() error {
+	conn, err := s.factory()
+	s.record(err)
+
+	if err != nil {
+		return err
+	}
+
+	c := epp.NewClient(conn, s.options...)
+	trackSession(conn, c)
+
+	s.clients = append(s.clients, c)
+
+	return nil
+}
+
+func (s *sharedSource) Get() (*epp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop sessions that broke since they were last handed out.
+	live := s.clients[:0]
+	for _, c := range s.clients {
+		if c.Err() != nil {
+			c.Close()
+			continue
+		}
+		live = append(live, c)
+	}
+	s.clients = live
+
+	var best *epp.Client
+	for _, c := range s.clients {
+		if best == nil || c.Pending() < best.Pending() {
+			best = c
+		}
+	}
+
+	// Only open another session when every one has commands in flight.
+	if best != nil && (best.Pending() == 0 || len(s.clients) >= s.max) {
+		return best, nil
+	}
+
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+
+	return s.clients[len(s.clients)-1], nil
+}
+
+// Release leaves healthy sessions in place for everyone else.
+func (s *sharedSource) Release(c *epp.Client, healthy bool) {
+	if healthy {
+		return
+	}
+
+	ejectUnready(c)
+
+	s.mu.Lock()
+	for i, client := range s.clients {
+		if client == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	c.Close()
+}
+
+// record notes the outcome of a dial or health check. The caller holds mu.
+func (s *sharedSource) record(err error) {
+	if err != nil {
+		s.health.LastError = err.Error()
+	} else {
+		s.health.LastError = ""
+	}
+}
+
+// checkLoop checks the sessions with nothing in flight every interval and
+// replaces those that fail.
+func (s *sharedSource) checkLoop(interval time.Duration, check pool.Checker) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		clients := append([]*epp.Client(nil), s.clients...)
+		s.mu.Unlock()
+
+		for _, c := range clients {
+			if c.Pending() > 0 {
+				continue
+			}
+
+			err := check(c)
+
+			// Sessions are only greeted once a downstream connection first
+			// uses them, so min_idle ones may not have been yet.
+			if err == epp.ErrNotConnected {
+				continue
+			}
+
+			s.mu.Lock()
+			s.health.Checks++
+			s.health.LastCheck = time.Now()
+			if err != nil {
+				s.health.Failures++
+			}
+			s.record(err)
+			s.mu.Unlock()
+
+			if err != nil {
+				s.log.Warn("evicting session that failed health check", "upstream", c.RemoteAddr().String(), "err", err)
+				s.Release(c, false)
+				go s.replace(c)
+			}
+		}
+	}
+}
+
+// replace dials a session in place of a failed one and logs it in the same
+// way, so the clients that were on the old one find it ready when they retry.
+func (s *sharedSource) replace(old *epp.Client) {
+	s.mu.Lock()
+
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+
+	if len(s.clients) >= s.max {
+		s.mu.Unlock()
+		return
+	}
+
+	err := s.dial()
+	var c *epp.Client
+	if err == nil {
+		c = s.clients[len(s.clients)-1]
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		_, err = c.Connect()
+	}
+
+	if login := old.LoginFrame(); err == nil && login != nil {
+		_, err = c.LoginWithFrame(login)
+	}
+
+	if err != nil {
+		s.log.Error("failed to replace session", "err", err)
+
+		s.mu.Lock()
+		s.record(err)
+		s.mu.Unlock()
+
+		if c != nil {
+			s.Release(c, false)
+		}
+	}
+}
+
+func (s *sharedSource) Stats() pool.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.health
+	stats.Open = len(s.clients)
+
+	for _, c := range s.clients {
+		if c.Pending() == 0 {
+			stats.Idle++
+		}
+	}
+
+	return stats
+}
+
+func (s *sharedSource) Close() {
+	s.mu.Lock()
+
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+
+	clients := s.clients
+	s.clients = nil
+
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *epp.Client) {
+			defer wg.Done()
+			if err := c.Shutdown(s.logout); err != nil {
+				s.log.Warn("failed to log out upstream session", "upstream", c.RemoteAddr().String(), "err", err)
+			}
+		}(c)
+	}
+
+	wg.Wait()
+}
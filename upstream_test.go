@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedSourceHealthCheckSkipsUngreetedSessions(t *testing.T) {
+	var dials int32
+
+	factory := func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+
+		client, registry := net.Pipe()
+
+		// The registry never gets a command, since the session is never
+		// greeted, but drain it anyway.
+		go io.Copy(io.Discard, registry)
+
+		return client, nil
+	}
+
+	health := &HealthCheckConfig{Interval: Duration(10 * time.Millisecond)}
+
+	s, err := newSharedSource(PoolConfig{MinIdle: 1, MaxOpen: 2}, 4, health, time.Second, factory, nil, slog.Default())
+	if err != nil {
+		t.Fatalf("newSharedSource failed with %v", err)
+	}
+	defer s.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	stats := s.Stats()
+
+	if stats.Failures != 0 || stats.LastError != "" {
+		t.Errorf("Expected no failed checks, got %d; %s", stats.Failures, stats.LastError)
+	}
+
+	if stats.Open != 1 {
+		t.Errorf("Expected the min_idle session to stay open, got %d open", stats.Open)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected one dial, got %d", n)
+	}
+}
@@ -0,0 +1,165 @@
+// Package xsd validates EPP frames against the EPP 1.0 schemas, and any
+// extension schemas given, with libxml2. The validator is only built with the
+// xsd build tag, since it needs cgo; without it Load always fails.
+package xsd
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+//go:embed schemas/*.xsd
+var builtin embed.FS
+
+// builtinSchemas are in the order they import each other.
+var builtinSchemas = []string{
+	"eppcom-1.0.xsd",
+	"epp-1.0.xsd",
+	"host-1.0.xsd",
+	"domain-1.0.xsd",
+	"contact-1.0.xsd",
+	"secDNS-1.1.xsd",
+	"rgp-1.0.xsd",
+}
+
+// ValidationError is why a document isn't valid. Element is the XML of the
+// element at fault, if there is one.
+type ValidationError struct {
+	Line    int
+	Message string
+	Element string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+
+	return e.Message
+}
+
+type schemaFile struct {
+	namespace string
+	path      string
+}
+
+// writeSchemas writes the built in schemas to tmp along with a schema that
+// imports them and those in dir, and returns its path. libxml2 resolves the
+// imports between them by namespace once each has been loaded.
+func writeSchemas(tmp, dir string) (string, error) {
+	var files []schemaFile
+
+	for _, name := range builtinSchemas {
+		b, err := builtin.ReadFile("schemas/" + name)
+		if err != nil {
+			return "", err
+		}
+
+		path := filepath.Join(tmp, name)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return "", err
+		}
+
+		ns, err := targetNamespace(b)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+
+		files = append(files, schemaFile{namespace: ns, path: path})
+	}
+
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil {
+			return "", err
+		} else if !info.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", dir)
+		}
+
+		paths, err := filepath.Glob(filepath.Join(dir, "*.xsd"))
+		if err != nil {
+			return "", err
+		}
+
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+
+			ns, err := targetNamespace(b)
+			if err != nil {
+				return "", fmt.Errorf("%s: %v", path, err)
+			}
+
+			if path, err = filepath.Abs(path); err != nil {
+				return "", err
+			}
+
+			files = replaceSchema(files, schemaFile{namespace: ns, path: path})
+		}
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<schema xmlns="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:epplb:schemas">` + "\n")
+
+	for _, f := range files {
+		fmt.Fprintf(&b, "  <import namespace=%s schemaLocation=%s/>\n", attr(f.namespace), attr(f.path))
+	}
+
+	b.WriteString("</schema>\n")
+
+	main := filepath.Join(tmp, "epplb.xsd")
+
+	return main, os.WriteFile(main, b.Bytes(), 0600)
+}
+
+// replaceSchema puts f in place of the schema with the same namespace, or
+// after the rest if there isn't one.
+func replaceSchema(files []schemaFile, f schemaFile) []schemaFile {
+	for i := range files {
+		if files[i].namespace == f.namespace {
+			files[i] = f
+			return files
+		}
+	}
+
+	return append(files, f)
+}
+
+func targetNamespace(b []byte) (string, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "", fmt.Errorf("not a schema; %v", err)
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			for _, a := range start.Attr {
+				if a.Name.Local == "targetNamespace" {
+					return a.Value, nil
+				}
+			}
+
+			return "", fmt.Errorf("schema has no targetNamespace")
+		}
+	}
+}
+
+func attr(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+
+	return strconv.Quote(b.String())
+}
@@ -0,0 +1,203 @@
+//go:build xsd
+
+package xsd
+
+/*
+#cgo pkg-config: libxml-2.0
+
+#include <stdlib.h>
+#include <string.h>
+#include <libxml/parser.h>
+#include <libxml/tree.h>
+#include <libxml/xmlschemas.h>
+
+typedef struct {
+	char *msg;
+	char *elem;
+	int line;
+} xsdResult;
+
+// xsdDump serialises the element at fault, with the namespaces it uses, so
+// it can be quoted back to the client.
+static char *xsdDump(xmlNodePtr node) {
+	if (node != NULL && node->type == XML_ATTRIBUTE_NODE) {
+		node = node->parent;
+	}
+
+	if (node == NULL || node->type != XML_ELEMENT_NODE) {
+		return NULL;
+	}
+
+	xmlDocPtr doc = xmlNewDoc(BAD_CAST "1.0");
+	xmlNodePtr copy = xmlDocCopyNode(node, doc, 1);
+	char *out = NULL;
+
+	if (copy != NULL) {
+		xmlDocSetRootElement(doc, copy);
+		xmlReconciliateNs(doc, copy);
+
+		xmlBufferPtr buf = xmlBufferCreate();
+		if (xmlNodeDump(buf, doc, copy, 0, 0) > 0) {
+			out = strdup((const char *) xmlBufferContent(buf));
+		}
+		xmlBufferFree(buf);
+	}
+
+	xmlFreeDoc(doc);
+
+	return out;
+}
+
+static void xsdOnError(void *ctx, xmlErrorPtr err) {
+	xsdResult *r = ctx;
+
+	// The first error is the one that matters; later ones tend to follow
+	// from it. Warnings, such as for a namespace imported twice, don't.
+	if (r->msg != NULL || err == NULL || err->level < XML_ERR_ERROR) {
+		return;
+	}
+
+	r->msg = strdup(err->message != NULL ? err->message : "unknown error");
+	r->line = err->line;
+	r->elem = xsdDump(err->node);
+}
+
+static void xsdResultFree(xsdResult *r) {
+	free(r->msg);
+	free(r->elem);
+}
+
+static xmlSchemaPtr xsdParse(const char *path, xsdResult *r) {
+	xmlSchemaParserCtxtPtr ctxt = xmlSchemaNewParserCtxt(path);
+	if (ctxt == NULL) {
+		return NULL;
+	}
+
+	xmlSchemaSetParserStructuredErrors(ctxt, xsdOnError, r);
+	xmlSchemaPtr schema = xmlSchemaParse(ctxt);
+	xmlSchemaFreeParserCtxt(ctxt);
+
+	return schema;
+}
+
+static int xsdValidate(xmlSchemaPtr schema, const char *buf, int len, xsdResult *r) {
+	xmlParserCtxtPtr pctxt = xmlNewParserCtxt();
+	if (pctxt == NULL) {
+		return -1;
+	}
+
+	xmlDocPtr doc = xmlCtxtReadMemory(pctxt, buf, len, "frame.xml", NULL,
+		XML_PARSE_NONET | XML_PARSE_NOERROR | XML_PARSE_NOWARNING);
+
+	if (doc == NULL) {
+		xsdOnError(r, xmlCtxtGetLastError(pctxt));
+		xmlFreeParserCtxt(pctxt);
+		return -1;
+	}
+
+	xmlFreeParserCtxt(pctxt);
+
+	xmlSchemaValidCtxtPtr vctxt = xmlSchemaNewValidCtxt(schema);
+	if (vctxt == NULL) {
+		xmlFreeDoc(doc);
+		return -1;
+	}
+
+	xmlSchemaSetValidStructuredErrors(vctxt, xsdOnError, r);
+	int rc = xmlSchemaValidateDoc(vctxt, doc);
+
+	xmlSchemaFreeValidCtxt(vctxt);
+	xmlFreeDoc(doc);
+
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+func init() {
+	C.xmlInitParser()
+}
+
+// Schema is a compiled set of schemas. It is safe for concurrent use.
+type Schema struct {
+	ptr C.xmlSchemaPtr
+}
+
+// Load compiles the EPP 1.0, domain, host, contact, secDNS and rgp schemas
+// along with every .xsd file in dir, if one is given. A file in dir with
+// the target namespace of a built in schema replaces it.
+func Load(dir string) (*Schema, error) {
+	tmp, err := os.MkdirTemp("", "epplb-xsd")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	main, err := writeSchemas(tmp, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	path := C.CString(main)
+	defer C.free(unsafe.Pointer(path))
+
+	var r C.xsdResult
+	defer C.xsdResultFree(&r)
+
+	ptr := C.xsdParse(path, &r)
+	if ptr == nil {
+		if r.msg != nil {
+			return nil, fmt.Errorf("failed to compile schemas; %s", strings.TrimSpace(C.GoString(r.msg)))
+		}
+		return nil, errors.New("failed to compile schemas")
+	}
+
+	s := &Schema{ptr: ptr}
+	runtime.SetFinalizer(s, func(s *Schema) { C.xmlSchemaFree(s.ptr) })
+
+	return s, nil
+}
+
+// Validate checks that b is a well-formed document valid against the
+// schema. The error is a *ValidationError unless validation couldn't be
+// attempted at all.
+func (s *Schema) Validate(b []byte) error {
+	if len(b) == 0 {
+		return &ValidationError{Message: "empty document"}
+	}
+
+	var r C.xsdResult
+	defer C.xsdResultFree(&r)
+
+	rc := C.xsdValidate(s.ptr, (*C.char)(unsafe.Pointer(&b[0])), C.int(len(b)), &r)
+	runtime.KeepAlive(s)
+
+	if rc == 0 {
+		return nil
+	}
+
+	if r.msg == nil {
+		return errors.New("failed to validate document")
+	}
+
+	err := &ValidationError{
+		Line:    int(r.line),
+		Message: strings.TrimSpace(C.GoString(r.msg)),
+	}
+
+	if r.elem != nil {
+		err.Element = C.GoString(r.elem)
+	}
+
+	return err
+}
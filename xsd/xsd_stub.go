@@ -0,0 +1,17 @@
+//go:build !xsd
+
+package xsd
+
+import "errors"
+
+// Schema is unavailable unless epplb is built with the xsd tag; validation
+// needs cgo and libxml2.
+type Schema struct{}
+
+func Load(dir string) (*Schema, error) {
+	return nil, errors.New("schema validation needs epplb built with -tags xsd, cgo and libxml2")
+}
+
+func (s *Schema) Validate(b []byte) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !xsd
+
+package xsd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadWithoutTag(t *testing.T) {
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "-tags xsd") {
+		t.Errorf("Expected Load to refuse without the xsd tag, got %v", err)
+	}
+}
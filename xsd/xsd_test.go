@@ -0,0 +1,189 @@
+//go:build xsd
+
+package xsd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var valid = map[string]string{
+	"hello": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><hello/></epp>`,
+	"login": `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<epp xmlns="urn:ietf:params:xml:ns:epp-1.0">
+  <command>
+    <login>
+      <clID>ClientX</clID>
+      <pw>foo-BAR2</pw>
+      <newPW>bar-FOO2</newPW>
+      <options><version>1.0</version><lang>en</lang></options>
+      <svcs>
+        <objURI>urn:ietf:params:xml:ns:domain-1.0</objURI>
+        <svcExtension><extURI>urn:ietf:params:xml:ns:secDNS-1.1</extURI></svcExtension>
+      </svcs>
+    </login>
+    <clTRID>ABC-12345</clTRID>
+  </command>
+</epp>`,
+	"poll": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><poll op="ack" msgID="12345"/><clTRID>ABC-12346</clTRID></command></epp>`,
+	"domain create with secDNS": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create>` +
+		`<domain:create xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name><domain:period unit="y">2</domain:period>` +
+		`<domain:ns><domain:hostObj>ns1.example.net</domain:hostObj></domain:ns><domain:registrant>jd1234</domain:registrant>` +
+		`<domain:contact type="admin">sh8013</domain:contact><domain:authInfo><domain:pw>2fooBAR</domain:pw></domain:authInfo></domain:create></create>` +
+		`<extension><secDNS:create xmlns:secDNS="urn:ietf:params:xml:ns:secDNS-1.1"><secDNS:dsData><secDNS:keyTag>12345</secDNS:keyTag><secDNS:alg>3</secDNS:alg>` +
+		`<secDNS:digestType>1</secDNS:digestType><secDNS:digest>49FD46E6C4B45C55D4AC</secDNS:digest></secDNS:dsData></secDNS:create></extension>` +
+		`<clTRID>ABC-12345</clTRID></command></epp>`,
+	"domain restore": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><update><domain:update xmlns:domain="urn:ietf:params:xml:ns:domain-1.0">` +
+		`<domain:name>example.com</domain:name><domain:chg/></domain:update></update>` +
+		`<extension><rgp:update xmlns:rgp="urn:ietf:params:xml:ns:rgp-1.0"><rgp:restore op="request"/></rgp:update></extension></command></epp>`,
+	"contact create": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create><contact:create xmlns:contact="urn:ietf:params:xml:ns:contact-1.0">` +
+		`<contact:id>sh8013</contact:id><contact:postalInfo type="int"><contact:name>John Doe</contact:name><contact:addr>` +
+		`<contact:street>123 Example Dr.</contact:street><contact:city>Dulles</contact:city><contact:cc>US</contact:cc></contact:addr></contact:postalInfo>` +
+		`<contact:voice x="1234">+1.7035555555</contact:voice><contact:email>jdoe@example.com</contact:email>` +
+		`<contact:authInfo><contact:pw>2fooBAR</contact:pw></contact:authInfo><contact:disclose flag="0"><contact:voice/></contact:disclose>` +
+		`</contact:create></create><clTRID>ABC-12345</clTRID></command></epp>`,
+	"host update": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><update><host:update xmlns:host="urn:ietf:params:xml:ns:host-1.0">` +
+		`<host:name>ns1.example.com</host:name><host:add><host:addr ip="v4">192.0.2.22</host:addr><host:status s="clientUpdateProhibited"/></host:add>` +
+		`<host:chg><host:name>ns2.example.com</host:name></host:chg></host:update></update><clTRID>ABC-12345</clTRID></command></epp>`,
+	"domain transfer": `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><transfer op="request"><domain:transfer xmlns:domain="urn:ietf:params:xml:ns:domain-1.0">` +
+		`<domain:name>example.com</domain:name><domain:authInfo><domain:pw roid="JD1234-REP">2fooBAR</domain:pw></domain:authInfo>` +
+		`</domain:transfer></transfer><clTRID>ABC-12345</clTRID></command></epp>`,
+}
+
+func load(t *testing.T, dir string) *Schema {
+	t.Helper()
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed with %v", err)
+	}
+
+	return s
+}
+
+func TestValidateValid(t *testing.T) {
+	s := load(t, "")
+
+	for name, doc := range valid {
+		if err := s.Validate([]byte(doc)); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", name, err)
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	s := load(t, "")
+
+	err := s.Validate([]byte(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><create>` +
+		`<domain:create xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name>` +
+		`<domain:period unit="x">2</domain:period><domain:authInfo><domain:pw>2fooBAR</domain:pw></domain:authInfo>` +
+		`</domain:create></create><clTRID>ABC-12345</clTRID></command></epp>`))
+
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+
+	if !strings.Contains(verr.Message, "unit") {
+		t.Errorf("Expected the message to name the unit attribute, got '%v'", verr.Message)
+	}
+
+	expected := `<domain:period xmlns:domain="urn:ietf:params:xml:ns:domain-1.0" unit="x">2</domain:period>`
+	if verr.Element != expected {
+		t.Errorf("Expected element %s, got %s", expected, verr.Element)
+	}
+}
+
+func TestValidateUnknownExtension(t *testing.T) {
+	s := load(t, "")
+
+	err := s.Validate([]byte(`<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check>` +
+		`<domain:check xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name></domain:check></check>` +
+		`<extension><ext:check xmlns:ext="urn:example:ext-1.0"><ext:flag>1</ext:flag></ext:check></extension></command></epp>`))
+
+	if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("Expected a ValidationError for an unknown extension, got %v", err)
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	s := load(t, "")
+
+	for _, doc := range []string{"", "<epp", "not xml"} {
+		if _, ok := s.Validate([]byte(doc)).(*ValidationError); !ok {
+			t.Errorf("Expected a ValidationError for %q", doc)
+		}
+	}
+}
+
+func TestLoadExtensionSchemas(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "ext-1.0.xsd"), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<schema targetNamespace="urn:example:ext-1.0" xmlns:ext="urn:example:ext-1.0" xmlns:eppcom="urn:ietf:params:xml:ns:eppcom-1.0"
+        xmlns="http://www.w3.org/2001/XMLSchema" elementFormDefault="qualified">
+  <import namespace="urn:ietf:params:xml:ns:eppcom-1.0"/>
+  <element name="check">
+    <complexType>
+      <sequence>
+        <element name="flag" type="boolean"/>
+        <element name="label" type="eppcom:labelType" minOccurs="0"/>
+      </sequence>
+    </complexType>
+  </element>
+</schema>`), 0600)
+
+	s := load(t, dir)
+
+	doc := `<epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><command><check>` +
+		`<domain:check xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:name>example.com</domain:name></domain:check></check>` +
+		`<extension><ext:check xmlns:ext="urn:example:ext-1.0"><ext:flag>%s</ext:flag></ext:check></extension></command></epp>`
+
+	if err := s.Validate([]byte(strings.Replace(doc, "%s", "1", 1))); err != nil {
+		t.Errorf("Expected the extension to be valid, got %v", err)
+	}
+
+	if err := s.Validate([]byte(strings.Replace(doc, "%s", "maybe", 1))); err == nil {
+		t.Error("Expected an invalid extension value to fail")
+	}
+}
+
+func TestLoadBadExtensionSchema(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "bad.xsd"), []byte(`<schema xmlns="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:bad"><element name="x" type="nope"/></schema>`), 0600)
+
+	if _, err := Load(dir); err == nil {
+		t.Error("Expected a schema with an unknown type to fail to load")
+	}
+}
+
+func TestLoadMissingDirectory(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected a missing directory to fail to load")
+	}
+}
+
+func TestValidateConcurrently(t *testing.T) {
+	s := load(t, "")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := s.Validate([]byte(valid["login"])); err != nil {
+					t.Errorf("Expected login to be valid, got %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}